@@ -0,0 +1,292 @@
+package hpack
+
+import (
+	"errors"
+)
+
+// Decoder decodes a header block given in fragments (e.g. HEADERS and
+// CONTINUATION frames) without joining them.
+// integers are kept until they are complete, and string literals are decoded
+// as they arrive (huffman coded ones by HuffmanDecoder).
+// every decoded header field is passed to emit.
+//
+//  d := NewDecoder(HpackConn{TableSizeLimit: 4096}, func(kv KeyValue) { ... })
+//  d.Write(headersFragment)
+//  d.Write(continuationFragment)
+//  d.Close() // end of the header block
+type Decoder struct {
+	con  HpackConn
+	emit func(kv KeyValue)
+
+	state    decodeState
+	pending  []byte // incomplete integer (with the first byte)
+	indexing Indexing
+	index    uint64 // index of the name (0: literal name)
+	key      string
+
+	// string literal
+	huffman bool
+	remain  uint64 // octets of the string not received yet
+	wireLen uint64
+	raw     []byte
+	huf     HuffmanDecoder
+}
+
+type decodeState uint8
+
+const (
+	stateField     decodeState = iota // first byte of a header field representation
+	stateNameLen                      // length of the name string
+	stateName                         // name string
+	stateValueLen                     // length of the value string
+	stateValue                        // value string
+)
+
+// maximum length of a prefixed integer (64 bit)
+const maxIntLen = 10
+
+// NewDecoder returns a Decoder which uses the dynamic table of con.
+func NewDecoder(con HpackConn, emit func(kv KeyValue)) *Decoder {
+	return &Decoder{con: con, emit: emit}
+}
+
+// Conn returns the current state of the dynamic table.
+// it can be given to DecodeHeader.
+func (d *Decoder) Conn() HpackConn {
+	return d.con
+}
+
+// Stats returns the statistics of the dynamic table.
+func (d *Decoder) Stats() Stats {
+	return d.con.Stats()
+}
+
+// Snapshot serializes the dynamic table (see HpackConn.Snapshot).
+func (d *Decoder) Snapshot() ([]byte, error) {
+	return d.con.Snapshot()
+}
+
+// Restore restores the dynamic table (see HpackConn.Restore).
+// it must be called between header blocks.
+func (d *Decoder) Restore(b []byte) error {
+	if d.state != stateField || len(d.pending) != 0 {
+		return errors.New("Restore: in the middle of a header block")
+	}
+	return d.con.Restore(b)
+}
+
+// Write decodes a fragment of the header block.
+// a header field may be cut at any point, the rest is expected in the next Write.
+func (d *Decoder) Write(p []byte) (int, error) {
+	d.con.stats.WireBytes += uint64(len(p))
+	b := p
+	for len(b) > 0 {
+		var err error
+		switch d.state {
+		case stateName, stateValue:
+			b, err = d.readString(b)
+		default:
+			b, err = d.readInt(b)
+		}
+		if err != nil {
+			d.reset()
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close tells the end of the header block.
+// an error is returned when the block ends in the middle of a header field.
+func (d *Decoder) Close() error {
+	if d.state != stateField || len(d.pending) != 0 {
+		d.reset()
+		return errors.New("Close: truncated header block")
+	}
+	return nil
+}
+
+// DecodeFull decodes a complete header block and returns the header list.
+func (d *Decoder) DecodeFull(encoded []byte) ([]KeyValue, error) {
+	emit := d.emit
+	defer func() { d.emit = emit }()
+
+	headers := []KeyValue{}
+	d.emit = func(kv KeyValue) {
+		headers = append(headers, kv)
+		if emit != nil {
+			emit(kv)
+		}
+	}
+	if _, err := d.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// reset drops the header field in progress
+func (d *Decoder) reset() {
+	d.state = stateField
+	d.pending = d.pending[:0]
+	d.raw = d.raw[:0]
+	d.huf.Reset()
+}
+
+// prefix returns the prefix length of the integer in progress.
+func (d *Decoder) prefix() uint8 {
+	if d.state != stateField {
+		// | H |    String Length (7+)     |
+		return 7
+	}
+	switch first := d.pending[0]; {
+	case first&128 == 128:
+		return 7
+	case first&192 == 64:
+		return 6
+	case first&224 == 32:
+		return 5
+	default:
+		return 4
+	}
+}
+
+// readInt reads a prefixed integer byte by byte.
+func (d *Decoder) readInt(b []byte) ([]byte, error) {
+	for len(b) > 0 {
+		d.pending = append(d.pending, b[0])
+		b = b[1:]
+
+		n := d.prefix()
+		last := d.pending[len(d.pending)-1]
+		if len(d.pending) == 1 && d.pending[0]&(1<<n-1) < 1<<n-1 || len(d.pending) > 1 && last&128 == 0 {
+			i, _, err := decodeIntValue(d.pending, n)
+			if err != nil {
+				return nil, err
+			}
+			first := d.pending[0]
+			d.pending = d.pending[:0]
+			return b, d.onInt(first, i)
+		}
+		if len(d.pending) > maxIntLen {
+			return nil, errors.New("Write: integer overflow")
+		}
+	}
+	return b, nil
+}
+
+func (d *Decoder) onInt(first byte, i uint64) error {
+	switch d.state {
+	case stateNameLen, stateValueLen:
+		d.huffman = first&128 == 128
+		d.remain, d.wireLen = i, i
+		d.state++
+		if i == 0 {
+			return d.finishString()
+		}
+		return nil
+	}
+
+	switch {
+	case first&128 == 128:
+		// 6.1 Indexed Header Field
+		kv, err := d.lookup(i)
+		if err != nil {
+			return err
+		}
+		d.con.countField(*kv, true, IncrementalIndexing, i)
+		d.field(*kv)
+		return nil
+	case first&224 == 32:
+		// 6.3 Dynamic Table Size Update
+		return d.con.updateTableSize(i)
+	case first&192 == 64:
+		// 6.2.1 Literal Header Field with Incremental Indexing
+		d.indexing = IncrementalIndexing
+	case first&240 == 0:
+		// 6.2.2 Literal Header Field without Indexing
+		d.indexing = WithoutIndexing
+	case first&240 == 16:
+		// 6.2.3 Literal Header Field Never Indexed
+		d.indexing = NeverIndexed
+	default:
+		return errors.New("Write: can't decode")
+	}
+
+	d.index = i
+	if i == 0 {
+		d.state = stateNameLen
+		return nil
+	}
+	kv, err := d.lookup(i)
+	if err != nil {
+		return err
+	}
+	d.key = kv.Key
+	d.state = stateValueLen
+	return nil
+}
+
+// lookup returns the entry of index i in the static and dynamic tables.
+func (d *Decoder) lookup(i uint64) (*KeyValue, error) {
+	return decodeHeaderTable(i, d.con.DynamicTable)
+}
+
+// readString consumes the string literal in progress.
+func (d *Decoder) readString(b []byte) ([]byte, error) {
+	n := d.remain
+	if uint64(len(b)) < n {
+		n = uint64(len(b))
+	}
+	if d.huffman {
+		if _, err := d.huf.Write(b[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		d.raw = append(d.raw, b[:n]...)
+	}
+	d.remain -= n
+	if d.remain == 0 {
+		if err := d.finishString(); err != nil {
+			return nil, err
+		}
+	}
+	return b[n:], nil
+}
+
+func (d *Decoder) finishString() error {
+	var s string
+	if d.huffman {
+		v, err := d.huf.Finish()
+		if err != nil {
+			return err
+		}
+		s = v
+		d.con.countHuffman(len(s), int(d.wireLen))
+	} else {
+		s = string(d.raw)
+		d.raw = d.raw[:0]
+	}
+
+	if d.state == stateName {
+		d.key = s
+		d.state = stateValueLen
+		return nil
+	}
+	kv := KeyValue{Key: d.key, Value: s}
+	d.con.countField(kv, false, d.indexing, d.index)
+	if d.indexing == IncrementalIndexing {
+		d.con.addHeader(kv)
+	}
+	d.state = stateField
+	d.field(kv)
+	return nil
+}
+
+func (d *Decoder) field(kv KeyValue) {
+	if d.emit != nil {
+		d.emit(kv)
+	}
+}
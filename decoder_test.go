@@ -0,0 +1,184 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestHuffmanDecoderFragments(t *testing.T) {
+	for _, str := range []string{"", "a", "www.example.com", "no-cache", "custom-value", "Mon, 21 Oct 2013 20:13:21 GMT", "\x00\xff\x7f\x80"} {
+		encoded := HuffmanEncode(nil, str)
+		for k := 0; k <= len(encoded); k++ {
+			h := HuffmanDecoder{}
+			h.Write(encoded[:k])
+			if _, err := h.Write(encoded[k:]); err != nil {
+				t.Fatalf("Error HuffmanDecoder %q split=%d: %v", str, k, err)
+			}
+			ans, err := h.Finish()
+			if err != nil || ans != str {
+				t.Fatalf("Error HuffmanDecoder split=%d: want=%q, ans=%q %v", k, str, ans, err)
+			}
+		}
+	}
+
+	// padding longer than 7 bits / padding with 0
+	for _, b := range [][]byte{{0x1f, 0xff}, {0x00}} {
+		h := HuffmanDecoder{}
+		h.Write(b)
+		if _, err := h.Finish(); err == nil {
+			t.Fatalf("Error HuffmanDecoder %x: want error", b)
+		}
+	}
+}
+
+// decodeFragments feeds wire to a Decoder cut at every position in split
+func decodeFragments(con HpackConn, wire []byte, split ...int) ([]KeyValue, HpackConn, error) {
+	headers := []KeyValue{}
+	d := NewDecoder(con, func(kv KeyValue) { headers = append(headers, kv) })
+	prev := 0
+	for _, k := range append(split, len(wire)) {
+		if _, err := d.Write(wire[prev:k]); err != nil {
+			return nil, HpackConn{}, err
+		}
+		prev = k
+	}
+	if err := d.Close(); err != nil {
+		return nil, HpackConn{}, err
+	}
+	return headers, d.Conn(), nil
+}
+
+func TestDecoderFragments(t *testing.T) {
+	for _, c := range appendixCases {
+		con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: c.limit}
+		for i, block := range c.blocks {
+			wire := appendixWire(t, block.wire)
+			var next HpackConn
+			for k := 0; k <= len(wire); k++ {
+				name := fmt.Sprintf("%s block %d split %d", c.name, i+1, k)
+				decoded, n, err := decodeFragments(con, wire, k)
+				if err != nil {
+					t.Fatalf("Error %s: %v", name, err)
+				}
+				if fmt.Sprint(decoded) != fmt.Sprint(block.headers) {
+					t.Fatalf("Error %s: want=%v, ans=%v", name, block.headers, decoded)
+				}
+				checkAppendixTable(t, name, n, block)
+				next = n
+			}
+
+			// one byte per Write
+			split := []int{}
+			for k := 1; k < len(wire); k++ {
+				split = append(split, k)
+			}
+			decoded, _, err := decodeFragments(con, wire, split...)
+			if err != nil || fmt.Sprint(decoded) != fmt.Sprint(block.headers) {
+				t.Fatalf("Error %s block %d byte by byte: want=%v, ans=%v %v", c.name, i+1, block.headers, decoded, err)
+			}
+			con = next
+		}
+	}
+}
+
+// the streaming decoder gives the same result as DecodeHeader
+func TestDecoderStory(t *testing.T) {
+	for name, s := range loadStories(t, "testdata/story_*.json") {
+		con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+		d := NewDecoder(con, nil)
+		for _, c := range s.Cases {
+			wire, _ := hex.DecodeString(c.Wire)
+			want, next, err := DecodeHeader(wire, con)
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			// cut in the middle of the block
+			d.Write(wire[:len(wire)/3])
+			decoded, err := d.DecodeFull(wire[len(wire)/3:])
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			if fmt.Sprint(want[len(want)-len(decoded):]) != fmt.Sprint(decoded) {
+				t.Fatalf("Error %s seqno %d: want=%v, ans=%v", name, c.Seqno, want, decoded)
+			}
+			if fmt.Sprint(d.Conn().DynamicTable) != fmt.Sprint(next.DynamicTable) {
+				t.Fatalf("Error %s seqno %d: dynamic table want=%v, ans=%v", name, c.Seqno, next.DynamicTable, d.Conn().DynamicTable)
+			}
+			con = next
+		}
+		if d.Stats() != con.Stats() {
+			t.Fatalf("Error %s: stats want=%+v, ans=%+v", name, con.Stats(), d.Stats())
+		}
+	}
+}
+
+func TestDecoderError(t *testing.T) {
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	for _, w := range []string{
+		"82 7f",         // integer is not complete
+		"40 0a 6375",    // name string is not complete
+		"41 8c f1e3 c2", // huffman coded value is not complete
+	} {
+		d := NewDecoder(con, nil)
+		d.Write(appendixWire(t, w))
+		if err := d.Close(); err == nil {
+			t.Fatalf("Error Close %s: want error", w)
+		}
+		// the decoder can be used for the next block
+		if _, err := d.DecodeFull([]byte{0x82}); err != nil {
+			t.Fatalf("Error DecodeFull after %s: %v", w, err)
+		}
+	}
+
+	d := NewDecoder(con, nil)
+	if _, err := d.Write([]byte{0xff, 0x80}); err != nil {
+		t.Fatalf("Error Write: %v", err)
+	}
+	if _, err := d.Write([]byte{0x01}); err == nil {
+		t.Fatalf("Error Write: want error for index out of range")
+	}
+
+	// 65538 must not be decoded as index 2 (:method: GET)
+	for _, w := range []string{
+		"ff 83ff 03",       // indexed header field
+		"7f c3ff 03 01 61", // literal with indexed name
+	} {
+		d := NewDecoder(con, nil)
+		if decoded, err := d.DecodeFull(appendixWire(t, w)); err == nil {
+			t.Fatalf("Error DecodeFull %s: want error for index out of range, ans=%v", w, decoded)
+		}
+	}
+}
+
+func TestDecodeSizeUpdate(t *testing.T) {
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	for _, c := range []struct {
+		wire string
+		ok   bool
+	}{
+		{"3f e1 1f", true},           // 4096
+		{"20 3f e1 1f", true},        // 0, then back to 4096
+		{"3f e2 1f", false},          // 4097
+		{"3f ff ff ff ff 0f", false}, // over uint32
+	} {
+		_, _, err := DecodeHeader(appendixWire(t, c.wire), con)
+		if (err == nil) != c.ok {
+			t.Fatalf("Error DecodeHeader %s: want ok=%v, ans=%v", c.wire, c.ok, err)
+		}
+		_, err = NewDecoder(con, nil).DecodeFull(appendixWire(t, c.wire))
+		if (err == nil) != c.ok {
+			t.Fatalf("Error DecodeFull %s: want ok=%v, ans=%v", c.wire, c.ok, err)
+		}
+	}
+
+	// the limit follows SetTableSizeLimit (e.g. ACKed SETTINGS_HEADER_TABLE_SIZE)
+	con.SetTableSizeLimit(8192)
+	if _, _, err := DecodeHeader(appendixWire(t, "3f e1 3f"), con); err != nil {
+		t.Fatalf("Error DecodeHeader: 8192 after SetTableSizeLimit %v", err)
+	}
+	con.SetTableSizeLimit(100)
+	if _, _, err := DecodeHeader(appendixWire(t, "3f e1 1f"), con); err == nil {
+		t.Fatalf("Error DecodeHeader: 4096 after SetTableSizeLimit(100) doesn't send error")
+	}
+}
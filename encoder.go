@@ -0,0 +1,66 @@
+package hpack
+
+import (
+	"io"
+)
+
+// Encoder encodes header blocks with its own dynamic table.
+// Encode writes the header block to w, AppendEncode appends it to a
+// caller-owned buffer.
+//
+//  e := NewEncoder(w, HpackConn{TableSizeLimit: 4096})
+//  e.Encode([]KeyValue{{":method", "GET"}, ...})
+type Encoder struct {
+	con HpackConn
+	w   io.Writer
+	buf []byte // reused by Encode
+}
+
+// NewEncoder returns an Encoder which uses the dynamic table of con.
+// w is only used by Encode, it can be nil when only AppendEncode is used.
+func NewEncoder(w io.Writer, con HpackConn) *Encoder {
+	return &Encoder{con: con, w: w}
+}
+
+// Conn returns the current state of the dynamic table.
+// it can be given to EncodeHeader.
+func (e *Encoder) Conn() HpackConn {
+	return e.con
+}
+
+// Stats returns the statistics of the dynamic table.
+func (e *Encoder) Stats() Stats {
+	return e.con.Stats()
+}
+
+// Snapshot serializes the dynamic table (see HpackConn.Snapshot).
+func (e *Encoder) Snapshot() ([]byte, error) {
+	return e.con.Snapshot()
+}
+
+// Restore restores the dynamic table (see HpackConn.Restore).
+func (e *Encoder) Restore(b []byte) error {
+	return e.con.Restore(b)
+}
+
+// AppendEncode appends the header block of fields to dst.
+// the dynamic table is not changed when an error is returned.
+func (e *Encoder) AppendEncode(dst []byte, fields []KeyValue) ([]byte, error) {
+	b, con, err := AppendEncodeHeader(dst, fields, e.con)
+	if err != nil {
+		return nil, err
+	}
+	e.con = con
+	return b, nil
+}
+
+// Encode writes the header block of fields to w.
+func (e *Encoder) Encode(fields []KeyValue) error {
+	b, err := e.AppendEncode(e.buf[:0], fields)
+	if err != nil {
+		return err
+	}
+	e.buf = b
+	_, err = e.w.Write(b)
+	return err
+}
@@ -0,0 +1,111 @@
+package hpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestAppendEncodeHeader(t *testing.T) {
+	c := appendixCaseNamed(t, "C.3")
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: c.limit, DisableHuffman: true, IndexPolicy: indexAll}
+	for i, block := range c.blocks {
+		// frame header (9 octets) is already in the buffer
+		dst := make([]byte, 9, 128)
+		copy(dst, "\x00\x01\x02\x03\x04\x05\x06\x07\x08")
+		b, next, err := AppendEncodeHeader(dst, block.headers, con)
+		if err != nil {
+			t.Fatalf("Error AppendEncodeHeader block %d: %v", i+1, err)
+		}
+		if &b[0] != &dst[0] {
+			t.Fatalf("Error AppendEncodeHeader block %d: dst is not reused", i+1)
+		}
+		if !bytes.Equal(b[:9], []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08")) {
+			t.Fatalf("Error AppendEncodeHeader block %d: dst is overwritten %x", i+1, b[:9])
+		}
+		want := hex.EncodeToString(appendixWire(t, block.wire))
+		if ans := hex.EncodeToString(b[9:]); ans != want {
+			t.Fatalf("Error AppendEncodeHeader block %d: want=%s, ans=%s", i+1, want, ans)
+		}
+		if next.Stats().WireBytes != con.Stats().WireBytes+uint64(len(b)-9) {
+			t.Fatalf("Error AppendEncodeHeader block %d: WireBytes=%d", i+1, next.Stats().WireBytes)
+		}
+		checkAppendixTable(t, fmt.Sprintf("AppendEncodeHeader block %d", i+1), next, block)
+		con = next
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	c := appendixCaseNamed(t, "C.6")
+	w := &bytes.Buffer{}
+	e := NewEncoder(w, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: c.limit, IndexPolicy: indexAll})
+	d := NewDecoder(HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: c.limit}, nil)
+	for i, block := range c.blocks {
+		w.Reset()
+		if err := e.Encode(block.headers); err != nil {
+			t.Fatalf("Error Encode block %d: %v", i+1, err)
+		}
+		want := hex.EncodeToString(appendixWire(t, block.wire))
+		if ans := hex.EncodeToString(w.Bytes()); ans != want {
+			t.Fatalf("Error Encode block %d: want=%s, ans=%s", i+1, want, ans)
+		}
+		checkAppendixTable(t, fmt.Sprintf("Encode block %d", i+1), e.Conn(), block)
+
+		decoded, err := d.DecodeFull(w.Bytes())
+		if err != nil || fmt.Sprint(decoded) != fmt.Sprint(block.headers) {
+			t.Fatalf("Error Encode block %d: want=%v, ans=%v %v", i+1, block.headers, decoded, err)
+		}
+	}
+
+	// AppendEncode shares the dynamic table with Encode
+	b, err := e.AppendEncode([]byte{0xff}, appendixRes3)
+	if err != nil || b[0] != 0xff {
+		t.Fatalf("Error AppendEncode: %x %v", b, err)
+	}
+	decoded, err := d.DecodeFull(b[1:])
+	if err != nil || fmt.Sprint(decoded) != fmt.Sprint(appendixRes3) {
+		t.Fatalf("Error AppendEncode: want=%v, ans=%v %v", appendixRes3, decoded, err)
+	}
+	if fmt.Sprint(e.Conn().DynamicTable) != fmt.Sprint(d.Conn().DynamicTable) {
+		t.Fatalf("Error AppendEncode: dynamic table mismatch encoder=%v, decoder=%v", e.Conn().DynamicTable, d.Conn().DynamicTable)
+	}
+}
+
+func TestSetTableSizeLimit(t *testing.T) {
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	_, con, _ = EncodeHeader(appendixReq1, con)
+	_, con, _ = EncodeHeader([]KeyValue{{Key: "custom-key", Value: "custom-header"}}, con)
+	if con.Len() != 2 {
+		t.Fatalf("Error SetTableSizeLimit: want 2 entries, ans=%d", con.Len())
+	}
+
+	// reduced to 0 and increased to 100 before the next block
+	con.SetTableSizeLimit(0)
+	if con.Len() != 0 {
+		t.Fatalf("Error SetTableSizeLimit: entries are not evicted %v", con.DynamicTable)
+	}
+	con.SetTableSizeLimit(100)
+	b, next, err := EncodeHeader([]KeyValue{{Key: ":method", Value: "GET"}}, con)
+	if err != nil {
+		t.Fatalf("Error SetTableSizeLimit: %v", err)
+	}
+	// 0x20: size 0, 0x3f45: size 100, 0x82: :method GET
+	if ans := hex.EncodeToString(b); ans != "203f4582" {
+		t.Fatalf("Error SetTableSizeLimit: want=203f4582, ans=%s", ans)
+	}
+	if next.Stats().SizeUpdates != 2 {
+		t.Fatalf("Error SetTableSizeLimit: SizeUpdates=%d", next.Stats().SizeUpdates)
+	}
+	// only once
+	b, _, _ = EncodeHeader([]KeyValue{{Key: ":method", Value: "GET"}}, next)
+	if ans := hex.EncodeToString(b); ans != "82" {
+		t.Fatalf("Error SetTableSizeLimit: want=82, ans=%s", ans)
+	}
+
+	dec := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	_, dec, err = DecodeHeader(appendixWire(t, "203f4582"), dec)
+	if err != nil || dec.TableSizeLimit != 100 {
+		t.Fatalf("Error SetTableSizeLimit: decoder table size %d %v", dec.TableSizeLimit, err)
+	}
+}
@@ -1,9 +1,7 @@
 package hpack
 
 import (
-	"bytes"
 	"errors"
-	"strings"
 	"net/http"
 )
 
@@ -54,148 +52,135 @@ func EncodeHeaderFromRequest(request *http.Request, con HpackConn) ([]byte, Hpac
 }
 
 func EncodeHeader(plainHeader []KeyValue, con HpackConn) ([]byte, HpackConn, error) {
-	dynamicHeader := con.DynamicTable
-	limit := con.TableSizeLimit
-
-	plainBuffer := plainHeader
-	encBuffer := []byte{}
-
-	for {
-		//enco
-		if strings.ToLower(plainBuffer[0].Key) != "cookie" && strings.ToLower(plainBuffer[0].Key) != "set-cookie" {
-			// not cookie
-			nhF, koF, index := searchHeaderTable(dynamicHeader, &plainBuffer[0])
-			if nhF == true {
-				// Not hit
-				//  0   1   2   3   4   5   6   7
-				//+---+---+---+---+---+---+---+---+
-				//| 0 | 1 |           0           |
-				//+---+---+-----------------------+
-				//| H |     Name Length (7+)      |
-				//+---+---------------------------+
-				//|  Name String (Length octets)  |
-				//+---+---------------------------+
-				//| H |     Value Length (7+)     |
-				//+---+---------------------------+
-				//| Value String (Length octets)  |
-				//+-------------------------------+
-				b := []byte{64}
-				// use huffman
-				b, err := encodeStrings(b, plainBuffer[0].Key, true)
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				b, err = encodeStrings(b, plainBuffer[0].Value, true)
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
+	return AppendEncodeHeader([]byte{}, plainHeader, con)
+}
 
-				encBuffer = append(encBuffer, b...)
+// AppendEncodeHeader appends the header block to dst.
+// dst can be a caller-owned buffer (e.g. a frame buffer with the frame header),
+// so that the header block is not copied again.
+//  return: dst + encodedHeader, dynamicHeader, error
+func AppendEncodeHeader(dst []byte, plainHeader []KeyValue, con HpackConn) ([]byte, HpackConn, error) {
+	encBuffer := dst
+
+	// 4.2. Maximum Table Size
+	//  the smallest size is signaled first when the limit was reduced and then increased
+	if con.sizeUpdate {
+		if con.minSize < con.TableSizeLimit {
+			encBuffer = appendSizeUpdate(encBuffer, con.minSize)
+			con.stats.SizeUpdates++
+		}
+		encBuffer = appendSizeUpdate(encBuffer, con.TableSizeLimit)
+		con.stats.SizeUpdates++
+		con.sizeUpdate = false
+	}
 
-				if len(dynamicHeader) > 0 {
-					dynamicHeader = append(dynamicHeader[0:1], dynamicHeader[0:]...)
-					dynamicHeader[0] = plainBuffer[0]
-				} else {
-					dynamicHeader = append(dynamicHeader, plainBuffer[0])
-				}
+	for _, kv := range plainHeader {
+		b, err := encodeHeaderField(encBuffer, kv, &con)
+		if err != nil {
+			return nil, HpackConn{}, err
+		}
+		encBuffer = b
+	}
 
-			} else if koF == true {
-				// Hit a Key Only
-				//  0   1   2   3   4   5   6   7
-				//+---+---+---+---+---+---+---+---+
-				//| 0 | 1 |      Index (6+)       |
-				//+---+---+-----------------------+
-				//| H |     Value Length (7+)     |
-				//+---+---------------------------+
-				//| Value String (Length octets)  |
-				//+-------------------------------+
+	con.stats.WireBytes += uint64(len(encBuffer) - len(dst))
+	return encBuffer, con, nil
+}
 
-				b, err := encodeIntValue([]byte{64}, 6, uint64(index))
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				b, err = encodeStrings(b, plainBuffer[0].Value, true)
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				encBuffer = append(encBuffer, b...)
+// 6.3. Dynamic Table Size Update
+//  0   1   2   3   4   5   6   7
+//+---+---+---+---+---+---+---+---+
+//| 0 | 0 | 1 |   Max size (5+)   |
+//+---+---------------------------+
+func appendSizeUpdate(dst []byte, size uint32) []byte {
+	b, _ := encodeIntValue(append(dst, 32), 5, uint64(size))
+	return b
+}
 
-				if len(dynamicHeader) > 0 {
-					dynamicHeader = append(dynamicHeader[0:1], dynamicHeader[0:]...)
-					dynamicHeader[0] = plainBuffer[0]
-				} else {
-					dynamicHeader = append(dynamicHeader, plainBuffer[0])
-				}
-			} else {
-				// Hit a Key & Value
-				// Index header field
-				//  0   1   2   3   4   5   6   7
-				//+---+---+---+---+---+---+---+---+
-				//| 1 |        Index (7+)         |
-				//+---+---------------------------+
-				b, err := encodeIntValue([]byte{128}, 7, uint64(index))
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				encBuffer = append(encBuffer, b...)
-			}
+// encodeHeaderField appends one header field to dst.
+// con.DynamicTable is updated when the field is indexed.
+func encodeHeaderField(dst []byte, kv KeyValue, con *HpackConn) ([]byte, error) {
+	indexing := con.indexing(kv)
+
+	nhF, koF, index := searchHeaderTable(con.DynamicTable, &kv)
+	if nhF == false && koF == false && indexing != NeverIndexed {
+		// Hit a Key & Value
+		// Index header field
+		//  0   1   2   3   4   5   6   7
+		//+---+---+---+---+---+---+---+---+
+		//| 1 |        Index (7+)         |
+		//+---+---------------------------+
+		con.countField(kv, true, indexing, uint64(index))
+		return encodeIntValue(append(dst, 128), 7, uint64(index))
+	}
 
-		} else {
-			// Cookie
-			//      0   1   2   3   4   5   6   7
-			//   +---+---+---+---+---+---+---+---+
-			//   | 0 | 0 | 0 | 1 |  Index (4+)   |
-			//   +---+---+-----------------------+
-			//   | H |     Value Length (7+)     |
-			//   +---+---------------------------+
-			//   | Value String (Length octets)  |
-			//   +-------------------------------+
-
-			// Cookie Index == 32
-			// Set-cookie Index == 55
-			var b []byte
-			if strings.ToLower(plainBuffer[0].Key) == "cookie" {
-				by, err := encodeIntValue([]byte{10}, 4, 32)
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				b = by
-			} else {
-				by, err := encodeIntValue([]byte{10}, 4, 55)
-				if err != nil {
-					return nil, HpackConn{}, err
-				}
-				b = by
-			}
-			b, err := encodeStrings(b, plainBuffer[0].Value, true)
-			if err != nil {
-				return nil, HpackConn{}, err
-			}
-			encBuffer = append(encBuffer, b...)
-		}
+	// Literal Header Field
+	//  with Incremental Indexing (01, Index 6+)
+	//  without Indexing          (0000, Index 4+)
+	//  Never Indexed             (0001, Index 4+)
+	//  0   1   2   3   4   5   6   7
+	//+---+---+---+---+---+---+---+---+
+	//| 0 | 1 |      Index (6+)       |
+	//+---+---+-----------------------+
+	//| H |     Value Length (7+)     |
+	//+---+---------------------------+
+	//| Value String (Length octets)  |
+	//+-------------------------------+
+	// Index == 0 (Not hit): the name is sent as a string literal
+	//  0   1   2   3   4   5   6   7
+	//+---+---+---+---+---+---+---+---+
+	//| 0 | 1 |           0           |
+	//+---+---+-----------------------+
+	//| H |     Name Length (7+)      |
+	//+---+---------------------------+
+	//|  Name String (Length octets)  |
+	//+---+---------------------------+
+	//| H |     Value Length (7+)     |
+	//+---+---------------------------+
+	//| Value String (Length octets)  |
+	//+-------------------------------+
+	var prefix byte
+	var n uint8
+	switch indexing {
+	case IncrementalIndexing:
+		prefix, n = 64, 6
+	case WithoutIndexing:
+		prefix, n = 0, 4
+	case NeverIndexed:
+		prefix, n = 16, 4
+	default:
+		return nil, errors.New("encodeHeaderField: unknown indexing")
+	}
 
-		// forloop conditions
-		if len(plainBuffer) != 1 {
-			plainBuffer = plainBuffer[1:]
-		} else {
-			break
+	b, err := encodeIntValue(append(dst, prefix), n, uint64(index))
+	if err != nil {
+		return nil, err
+	}
+	if nhF == true {
+		b, err = con.encodeString(b, kv.Key)
+		if err != nil {
+			return nil, err
 		}
 	}
+	b, err = con.encodeString(b, kv.Value)
+	if err != nil {
+		return nil, err
+	}
 
-	dynamicHeader = cutHeader(dynamicHeader, int(limit))
-	return encBuffer, HpackConn{dynamicHeader, limit}, nil
+	con.countField(kv, false, indexing, uint64(index))
+	if indexing == IncrementalIndexing {
+		con.addHeader(kv)
+	}
+	return b, nil
 }
 
 // DecodeHeader
 //  encoded bytes
 //   return: decodedHeader, dynamicHeader, error
 func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error) {
-	dynamicHeader := con.DynamicTable
-	limit := con.TableSizeLimit
-
 	//dHeader
 	headerBuffer := []KeyValue{}
 	encBuffer := encoded
+	con.stats.WireBytes += uint64(len(encoded))
 
 	for len(encBuffer) != 0 {
 		// index header field
@@ -210,11 +195,12 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 			if err != nil {
 				return nil, HpackConn{}, err
 			}
-			kv, err := decodeHeaderTable(uint16(i), dynamicHeader)
+			kv, err := decodeHeaderTable(i, con.DynamicTable)
 			if err != nil {
 				return nil, HpackConn{}, err
 			}
 			headerBuffer = append(headerBuffer, *kv)
+			con.countField(*kv, true, IncrementalIndexing, i)
 		} else if encBuffer[0]&192 == 64 {
 			//// 6.2.1 インデックス更新を伴うリテラルヘッダフィールド
 			if encBuffer[0]&63 == 0 {
@@ -231,23 +217,19 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 				//+---+---------------------------+
 				//| Value String (Length octets)  |
 				//+-------------------------------+
-				key, eB, err := decodeStrings(encBuffer[1:])
+				key, eB, err := con.decodeString(encBuffer[1:])
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				value, eB, err := decodeStrings(encBuffer)
+				value, eB, err := con.decodeString(encBuffer)
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
 				headerBuffer = append(headerBuffer, KeyValue{key, value})
-				if len(dynamicHeader) > 0 {
-					dynamicHeader = append(dynamicHeader[:1], dynamicHeader[0:]...)
-					dynamicHeader[0] = KeyValue{key, value}
-				} else {
-					dynamicHeader = append(dynamicHeader, KeyValue{key, value})
-				}
+				con.countField(KeyValue{key, value}, false, IncrementalIndexing, 0)
+				con.addHeader(KeyValue{key, value})
 			} else {
 				// Index != 0
 				//  0   1   2   3   4   5   6   7
@@ -263,24 +245,24 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				kv, err := decodeHeaderTable(uint16(i), dynamicHeader)
+				kv, err := decodeHeaderTable(i, con.DynamicTable)
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				value, eB, err := decodeStrings(encBuffer)
+				value, eB, err := con.decodeString(encBuffer)
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
 				headerBuffer = append(headerBuffer, KeyValue{kv.Key, value})
-				if len(dynamicHeader) > 0 {
-					dynamicHeader = append(dynamicHeader[:1], dynamicHeader[0:]...)
-					dynamicHeader[0] = KeyValue{kv.Key, value}
-				} else {
-					dynamicHeader = append(dynamicHeader, KeyValue{kv.Key, value})
-				}
+				con.countField(KeyValue{kv.Key, value}, false, IncrementalIndexing, i)
+				con.addHeader(KeyValue{kv.Key, value})
 			}
 		} else if encBuffer[0]&240 == 0 || encBuffer[0]&240 == 16 {
+			indexing := WithoutIndexing
+			if encBuffer[0]&240 == 16 {
+				indexing = NeverIndexed
+			}
 			if encBuffer[0]&15 == 0 {
 				// Index = 0
 				//  0   1   2   3   4   5   6   7
@@ -295,18 +277,18 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 				//+---+---------------------------+
 				//| Value String (Length octets)  |
 				//+-------------------------------+
-				key, eB, err := decodeStrings(encBuffer[1:])
+				key, eB, err := con.decodeString(encBuffer[1:])
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				value, eB, err := decodeStrings(encBuffer)
+				value, eB, err := con.decodeString(encBuffer)
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
 				headerBuffer = append(headerBuffer, KeyValue{key, value})
-
+				con.countField(KeyValue{key, value}, false, indexing, 0)
 			} else {
 				// Index != 0
 				//  0   1   2   3   4   5   6   7
@@ -322,16 +304,17 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				kv, err := decodeHeaderTable(uint16(i), dynamicHeader)
+				kv, err := decodeHeaderTable(i, con.DynamicTable)
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
-				value, eB, err := decodeStrings(encBuffer)
+				value, eB, err := con.decodeString(encBuffer)
 				encBuffer = eB
 				if err != nil {
 					return nil, HpackConn{}, err
 				}
 				headerBuffer = append(headerBuffer, KeyValue{kv.Key, value})
+				con.countField(KeyValue{kv.Key, value}, false, indexing, i)
 			}
 		} else if encBuffer[0]&224 == 32 {
 			// not correspond!
@@ -345,36 +328,31 @@ func DecodeHeader(encoded []byte, con HpackConn) ([]KeyValue, HpackConn, error)
 			if err != nil {
 				return nil, HpackConn{}, err
 			}
-			limit = uint32(i)
+			if err := con.updateTableSize(i); err != nil {
+				return nil, HpackConn{}, err
+			}
 		} else {
 			return nil, HpackConn{}, errors.New("DecodeHeader: can't decode")
 		}
 	}
 
-	dynamicHeader = cutHeader(dynamicHeader, int(limit))
-	return headerBuffer, HpackConn{dynamicHeader, limit}, nil
+	return headerBuffer, con, nil
 }
 
-// エンコード時のテーブル格納は同時実施しない？今の実装はおかしいと思われる.
-// return: NotHitFlag, HitKeyOnlyFlag, dynamicHeaderTable, hitInt
+// エンコード時のテーブル格納はencodeHeaderFieldで実施する
+// static table is preferred so that the index does not change with the dynamic table.
+// return: NotHitFlag, HitKeyOnlyFlag, hitInt
 func searchHeaderTable(dHeaderTable []KeyValue, plain *KeyValue) (bool, bool, int) {
-	// Hit the dynamic header table
-	for c, v := range dHeaderTable {
-		if v.Key == plain.Key && v.Value == plain.Value {
-			return false, false, c + 62
-		}
-	}
 	// Hit the static header table
 	for c, v := range staticHeaderTable {
 		if v.Key == plain.Key && v.Value == plain.Value {
 			return false, false, c + 1
 		}
 	}
-	// Hit the dynamic header table(Key only)
+	// Hit the dynamic header table
 	for c, v := range dHeaderTable {
-		if v.Key == plain.Key {
-			dHeaderTable = append(dHeaderTable, *plain)
-			return false, true, c + 62
+		if v.Key == plain.Key && v.Value == plain.Value {
+			return false, false, c + 62
 		}
 	}
 	// Hit the static header table(Key only)
@@ -383,14 +361,21 @@ func searchHeaderTable(dHeaderTable []KeyValue, plain *KeyValue) (bool, bool, in
 			return false, true, c + 1
 		}
 	}
+	// Hit the dynamic header table(Key only)
+	for c, v := range dHeaderTable {
+		if v.Key == plain.Key {
+			return false, true, c + 62
+		}
+	}
 	// Not hit
 	return true, false, 0
 
 }
 
 // デコード時にはテーブル格納はしない
-func decodeHeaderTable(idx uint16, dHeaderTable []KeyValue) (*KeyValue, error) {
-	if idx <= 0 || idx > uint16(61+len(dHeaderTable)) {
+// idx is the decoded integer as is, a large index must not wrap to a valid one.
+func decodeHeaderTable(idx uint64, dHeaderTable []KeyValue) (*KeyValue, error) {
+	if idx == 0 || idx > uint64(len(staticHeaderTable)+len(dHeaderTable)) {
 		return nil, errors.New("decoderHeaderTable: wrong idx")
 	}
 	// static table
@@ -433,6 +418,10 @@ func decodeIntValue(original []byte, n uint8) (value uint64, remain []byte, err
 	if n > 8 {
 		return 0, nil, errors.New("bad n")
 	}
+	// the header block may end in the middle of the integer
+	if len(original) == 0 {
+		return 0, nil, errors.New("decodeIntValue: no octet")
+	}
 	// if I < 2^N - 1, return I
 	i := uint64((original[0]) & (1<<n - 1))
 	if i < (1<<n - 1) {
@@ -443,6 +432,12 @@ func decodeIntValue(original []byte, n uint8) (value uint64, remain []byte, err
 	tmp := uint64(1<<n - 1)
 	m := uint64(0)
 	for bi := 1; ; bi++ {
+		if bi >= len(original) {
+			return 0, nil, errors.New("decodeIntValue: truncated integer")
+		}
+		if m > 63 {
+			return 0, nil, errors.New("decodeIntValue: integer overflow")
+		}
 		b := original[bi]
 		bv := uint64(b & byte(127))
 		tmp += (bv << m)
@@ -487,9 +482,15 @@ func encodeIntValue(original []byte, n uint8, value uint64) (after []byte, err e
 //|  String Data (Length octets)  |
 //+-------------------------------+
 func decodeStrings(original []byte) (value string, remain []byte, err error) {
-	// huffman encoded
 	l, rb, err := decodeIntValue(original, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if l > uint64(len(rb)) {
+		return "", nil, errors.New("decodeStrings: truncated string")
+	}
 
+	// huffman encoded
 	if (original[0] & 128) == 128 {
 		encoded := rb[:l]
 		decoded, err := decodeHuffmanStrings(encoded)
@@ -499,9 +500,6 @@ func decodeStrings(original []byte) (value string, remain []byte, err error) {
 		return decoded, rb[l:], nil
 	}
 
-	if err != nil {
-		return "", nil, err
-	}
 	v := string(rb[:l])
 
 	// not encoded (just ascii)
@@ -511,12 +509,7 @@ func decodeStrings(original []byte) (value string, remain []byte, err error) {
 func encodeStrings(original []byte, str string, huf bool) (encoded []byte, err error) {
 	// huf encode
 	if huf == true {
-		var bin []Bin
-		for _, b := range []byte(str) {
-			bin = append(bin, huffmanEncodeTable[b]...)
-		}
-
-		enc := BinToByte(bin)
+		enc := HuffmanEncode(nil, str)
 		by := append(original, byte(128))
 		by, err := encodeIntValue(by, 7, uint64(len(enc)))
 		if err != nil {
@@ -536,47 +529,66 @@ func encodeStrings(original []byte, str string, huf bool) (encoded []byte, err e
 	return b, nil
 }
 
+// encodeString encodes a string literal with the encoder options of con.
+func (con *HpackConn) encodeString(dst []byte, str string) ([]byte, error) {
+	if con.DisableHuffman {
+		return encodeStrings(dst, str, false)
+	}
+	b, err := encodeStrings(dst, str, true)
+	if err != nil {
+		return nil, err
+	}
+	con.countHuffman(len(str), HuffmanEncodedLen(str))
+	return b, nil
+}
+
+// decodeString decodes a string literal and counts huffman coded ones.
+func (con *HpackConn) decodeString(original []byte) (string, []byte, error) {
+	v, remain, err := decodeStrings(original)
+	if err != nil {
+		return "", nil, err
+	}
+	if original[0]&128 == 128 {
+		l, _, _ := decodeIntValue(original, 7)
+		con.countHuffman(len(v), int(l))
+	}
+	return v, remain, nil
+}
+
+// Huffman codec (Appendix B)
+//  exported for the qpack package, which uses the same code.
+
+// HuffmanEncode appends the huffman coded str to dst.
+func HuffmanEncode(dst []byte, str string) []byte {
+	var bin []Bin
+	for _, b := range []byte(str) {
+		bin = append(bin, huffmanEncodeTable[b]...)
+	}
+	return append(dst, BinToByte(bin)...)
+}
+
+// HuffmanDecode decodes a huffman coded string.
+func HuffmanDecode(encoded []byte) (string, error) {
+	return decodeHuffmanStrings(encoded)
+}
+
+// HuffmanEncodedLen returns the length of str after huffman coding (octets).
+func HuffmanEncodedLen(str string) int {
+	bits := 0
+	for _, b := range []byte(str) {
+		bits += len(huffmanEncodeTable[b])
+	}
+	return (bits + 7) / 8
+}
+
 func decodeHuffmanStrings(encoded []byte) (string, error) {
 	// []byte 11100000
 	//        11011111
 	//        00001000
-	// string list
-	strByte := &bytes.Buffer{}
-
-	// convert Bin format
-	binlist := ByteToBin(encoded)
-
-	// decode Huffman
-	// minimum length : 5
-	// maximum length : 30
-	// Cur
-	// sChar
-	sChar := 0
-	for cur := 4; cur < len(binlist)+1; cur++ {
-		b := BinToUint32(binlist[sChar:cur])
-		codelen := cur - sChar
-		v, ok := huffmanDecodeTable[b]
-		if ok {
-			if v.codeLen == codelen {
-				strByte.WriteByte(v.b)
-				sChar = cur
-				continue
-			}
-		}
-		if cur-sChar > 30 {
-			err := errors.New("failed to decode huffman strings (can't find string)")
-			return "", err
-		}
-	}
-	if len(binlist[sChar:]) > 7 {
-		err := errors.New("failed to decode huffman strings (too much eos)")
+	// the whole string is given at once to the streaming decoder
+	h := HuffmanDecoder{}
+	if _, err := h.Write(encoded); err != nil {
 		return "", err
 	}
-	for _, bit := range binlist[sChar:len(binlist)] {
-		if bit == Zero {
-			err := errors.New("failed to decode huffman strings (wrong eos)")
-			return "", err
-		}
-	}
-	return string(strByte.Bytes()), nil
+	return h.Finish()
 }
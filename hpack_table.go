@@ -1,9 +1,60 @@
 package hpack
 
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
 // Hpack Connection State Struct
 type HpackConn struct {
 	DynamicTable   []KeyValue
 	TableSizeLimit uint32
+
+	// encoder options
+	//  DisableHuffman: send string literals without huffman coding
+	//  IndexPolicy: choose the representation of each field (nil: default policy)
+	DisableHuffman bool
+	IndexPolicy    func(kv KeyValue) Indexing
+
+	// number of entries inserted so far (absolute index of DynamicTable[0])
+	inserted uint64
+	stats    Stats
+
+	// Dynamic Table Size Update to be sent at the beginning of the next header block
+	//  minSize: the smallest limit since the last header block
+	sizeUpdate bool
+	minSize    uint32
+
+	// decoder: the largest size accepted in Dynamic Table Size Update
+	//  (SETTINGS_HEADER_TABLE_SIZE of the decoding side, set by SetTableSizeLimit)
+	//  0: TableSizeLimit before the first update
+	protocolSize uint32
+}
+
+// Indexing is the literal representation used by the encoder.
+type Indexing uint8
+
+const (
+	IncrementalIndexing Indexing = iota // 6.2.1 Literal Header Field with Incremental Indexing
+	WithoutIndexing                     // 6.2.2 Literal Header Field without Indexing
+	NeverIndexed                        // 6.2.3 Literal Header Field Never Indexed
+)
+
+// default policy: cookies are never stored in the dynamic table
+func defaultIndexPolicy(kv KeyValue) Indexing {
+	k := strings.ToLower(kv.Key)
+	if k == "cookie" || k == "set-cookie" {
+		return NeverIndexed
+	}
+	return IncrementalIndexing
+}
+
+func (con *HpackConn) indexing(kv KeyValue) Indexing {
+	if con.IndexPolicy == nil {
+		return defaultIndexPolicy(kv)
+	}
+	return con.IndexPolicy(kv)
 }
 
 // Header type
@@ -12,6 +63,73 @@ type KeyValue struct {
 	Value string
 }
 
+// 4.1. Calculating Table Size
+//  name + value + 32
+func entrySize(kv KeyValue) int {
+	return len(kv.Key) + len(kv.Value) + 32
+}
+
+func tableSize(kvSlice []KeyValue) int {
+	i := 0
+	for _, kv := range kvSlice {
+		i += entrySize(kv)
+	}
+	return i
+}
+
+// 4.4. Entry Eviction When Adding New Entries
+// the new entry is inserted at the head, then entries are evicted from the end
+// until the table fits in the limit. (a copy is made, the caller's slice is not modified)
+func (con *HpackConn) addHeader(kv KeyValue) {
+	before := len(con.DynamicTable)
+	table := append([]KeyValue{kv}, con.DynamicTable...)
+	con.DynamicTable = cutHeader(table, int(con.TableSizeLimit))
+	con.inserted++
+
+	// an entry larger than the table empties the table and is not added
+	if len(con.DynamicTable) == 0 {
+		con.stats.Evictions += uint64(before)
+	} else {
+		con.stats.Evictions += uint64(before + 1 - len(con.DynamicTable))
+	}
+}
+
+// 4.3. Entry Eviction When Dynamic Table Size Changes
+func (con *HpackConn) setTableSize(limit uint32) {
+	before := len(con.DynamicTable)
+	con.TableSizeLimit = limit
+	con.DynamicTable = cutHeader(con.DynamicTable, int(limit))
+	con.stats.Evictions += uint64(before - len(con.DynamicTable))
+}
+
+// SetTableSizeLimit changes the maximum size of the dynamic table
+// (e.g. SETTINGS_HEADER_TABLE_SIZE). entries are evicted at once, and the
+// encoder sends Dynamic Table Size Update at the beginning of the next header block.
+// the decoder accepts Dynamic Table Size Update up to limit.
+func (con *HpackConn) SetTableSizeLimit(limit uint32) {
+	if !con.sizeUpdate || limit < con.minSize {
+		con.minSize = limit
+	}
+	con.sizeUpdate = true
+	con.protocolSize = limit
+	con.setTableSize(limit)
+}
+
+// 6.3. Dynamic Table Size Update (decoder)
+//  the new maximum size must be lower than or equal to the limit set by
+//  the protocol, a larger value (or one over uint32) is a decoding error.
+func (con *HpackConn) updateTableSize(size uint64) error {
+	if con.protocolSize == 0 {
+		con.protocolSize = con.TableSizeLimit
+	}
+	if size > uint64(con.protocolSize) {
+		return fmt.Errorf("Dynamic Table Size Update %d exceeds the limit %d", size, con.protocolSize)
+	}
+	con.setTableSize(uint32(size))
+	con.stats.SizeUpdates++
+	return nil
+}
+
 func cutHeader(kvSlice []KeyValue, limit int) []KeyValue {
 	i := 0
 	for c, kv := range kvSlice {
@@ -25,6 +143,67 @@ func cutHeader(kvSlice []KeyValue, limit int) []KeyValue {
 	return kvSlice
 }
 
+// Dynamic table introspection
+//  index order is the HPACK index order: DynamicTable[0] is index 62 ([1] in RFC 7541 Appendix C)
+
+// Entry is a dynamic table entry.
+type Entry struct {
+	KeyValue
+	Index    int    // HPACK index (62 ~)
+	Absolute uint64 // insertion count of the entry (1 = first inserted entry)
+	Size     int    // name + value + 32
+}
+
+// Size returns the current table size in octets.
+func (con *HpackConn) Size() int {
+	return tableSize(con.DynamicTable)
+}
+
+// MaxSize returns the maximum table size in octets.
+func (con *HpackConn) MaxSize() uint32 {
+	return con.TableSizeLimit
+}
+
+// Len returns the number of entries.
+func (con *HpackConn) Len() int {
+	return len(con.DynamicTable)
+}
+
+// Entries returns the entries in HPACK index order (newest first).
+func (con *HpackConn) Entries() []Entry {
+	entries := []Entry{}
+	inserted := con.insertCount()
+	for c, kv := range con.DynamicTable {
+		entries = append(entries, Entry{
+			KeyValue: kv,
+			Index:    c + 62,
+			Absolute: inserted - uint64(c),
+			Size:     entrySize(kv),
+		})
+	}
+	return entries
+}
+
+// tables built by hand (e.g. HpackConn{DynamicTable: ...}) have no insertion history
+func (con *HpackConn) insertCount() uint64 {
+	if con.inserted < uint64(len(con.DynamicTable)) {
+		return uint64(len(con.DynamicTable))
+	}
+	return con.inserted
+}
+
+// String dumps the table like RFC 7541 Appendix C.
+//  [  1] (s =  55) custom-key: custom-header
+//        Table size:  55
+func (con *HpackConn) String() string {
+	buf := &bytes.Buffer{}
+	for c, e := range con.Entries() {
+		fmt.Fprintf(buf, "[%3d] (s = %3d) %s: %s\n", c+1, e.Size, e.Key, e.Value)
+	}
+	fmt.Fprintf(buf, "      Table size: %3d\n", con.Size())
+	return buf.String()
+}
+
 // Bin is a type for represent a binary(0 or 1).
 type Bin bool
 
@@ -35,6 +214,10 @@ const (
 
 func BinToByte(bi []Bin) []byte {
 	var dst []byte
+	// empty string has no padding
+	if len(bi) == 0 {
+		return dst
+	}
 	var buffer byte
 	c := 0
 	var cur uint8
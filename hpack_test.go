@@ -89,6 +89,16 @@ func TestDecodeHeaderTable(t *testing.T) {
 	if v.Key != "test2" || v.Value != "value2" {
 		t.Fatalf("Error encodeHeaderTable: want=:test, value1, ans=%v", v)
 	}
+
+	// out of the tables (65538 must not wrap to 2)
+	for _, idx := range []uint64{0, 64, 65538} {
+		if v, err := decodeHeaderTable(idx, dht); err == nil {
+			t.Fatalf("Error decodeHeaderTable: index %d doesn't send error %v", idx, v)
+		}
+	}
+	if _, _, err := DecodeHeader([]byte{0xff, 0x83, 0xff, 0x03}, HpackConn{TableSizeLimit: 4096}); err == nil {
+		t.Fatalf("Error DecodeHeader: index 65538 doesn't send error")
+	}
 }
 
 func TestEncodeHeaderTable(t *testing.T) {
@@ -115,26 +125,26 @@ func TestDecodeHeader(t *testing.T) {
 	// c2.1 example
 	encoded := []byte{0x40, 0x0a, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x6b, 0x65, 0x79, 0x0d, 0x63, 0x75, 0x73, 0x74, 0x6f, 0x6d, 0x2d, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72}
 	dHeader := []KeyValue{}
-	decoded, con, _ := DecodeHeader(encoded, HpackConn{dHeader, 4096})
-	if decoded[0].Key != "custom-Key" || decoded[0].Value != "custom-header" {
-		t.Fatalf("Error DecodeHeader: want=custom-Key, custom-header, ans=%v", decoded[0])
+	decoded, con, _ := DecodeHeader(encoded, HpackConn{DynamicTable: dHeader, TableSizeLimit: 4096})
+	if decoded[0].Key != "custom-key" || decoded[0].Value != "custom-header" {
+		t.Fatalf("Error DecodeHeader: want=custom-key, custom-header, ans=%v", decoded[0])
 	}
-	if con.DynamicTable[0].Key != "custom-Key" || con.DynamicTable[0].Value != "custom-header" {
-		t.Fatalf("Error DecodeHeader: want=custom-Key, custom-header, ans=%v", con.DynamicTable[0])
+	if con.DynamicTable[0].Key != "custom-key" || con.DynamicTable[0].Value != "custom-header" {
+		t.Fatalf("Error DecodeHeader: want=custom-key, custom-header, ans=%v", con.DynamicTable[0])
 	}
 
 	// c2.2 example
 	encoded = append(encoded, []byte{0x04, 0x0c, 0x2f, 0x73, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2f, 0x70, 0x61, 0x74, 0x68}...)
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 4096})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
 
-	if decoded[0].Key != "custom-Key" || decoded[0].Value != "custom-header" {
-		t.Fatalf("Error DecodeHeader: want=custom-Key, custom-header, ans=%v", decoded[0])
+	if decoded[0].Key != "custom-key" || decoded[0].Value != "custom-header" {
+		t.Fatalf("Error DecodeHeader: want=custom-key, custom-header, ans=%v", decoded[0])
 	}
 	if decoded[1].Key != ":path" || decoded[1].Value != "/sample/path" {
 		t.Fatalf("Error DecodeHeader: want=:path, /sample/path, ans=%v", decoded[0])
 	}
-	if con.DynamicTable[0].Key != "custom-Key" || con.DynamicTable[0].Value != "custom-header" {
-		t.Fatalf("Error DecodeHeader: want=custom-Key, custom-header, ans=%v", con.DynamicTable[0])
+	if con.DynamicTable[0].Key != "custom-key" || con.DynamicTable[0].Value != "custom-header" {
+		t.Fatalf("Error DecodeHeader: want=custom-key, custom-header, ans=%v", con.DynamicTable[0])
 	}
 	if len(con.DynamicTable) != 1 {
 		t.Fatalf("Error DecodeHeader: want=1, ans=%v", len(con.DynamicTable))
@@ -142,7 +152,7 @@ func TestDecodeHeader(t *testing.T) {
 
 	// c3.1
 	encoded = []byte{0x82, 0x86, 0x84, 0x41, 0x0f, 0x77, 0x77, 0x77, 0x2e, 0x65, 0x78, 0x61, 0x6d, 0x70, 0x6c, 0x65, 0x2e, 0x63, 0x6f, 0x6d}
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 4096})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
 
 	// c3.2
 	encoded = []byte{0x82, 0x86, 0x84, 0xbe, 0x58, 0x08, 0x6e, 0x6f, 0x2d, 0x63, 0x61, 0x63, 0x68, 0x65}
@@ -152,10 +162,10 @@ func TestDecodeHeader(t *testing.T) {
 	//:scheme: https
 	//:path: /index.html
 	//:authority: www.example.com
-	//custom-Key: custom-Value
+	//custom-key: custom-value
 	//
 	//  [dynamic header table]
-	//[  1] (s =  54) custom-Key: custom-Value
+	//[  1] (s =  54) custom-key: custom-value
 	//[  2] (s =  53) cache-control: no-cache
 	//[  3] (s =  57) :authority: www.example.com
 	//      Table size: 164
@@ -166,18 +176,18 @@ func TestDecodeHeader(t *testing.T) {
 		decoded[1].Key != ":scheme" || decoded[1].Value != "https" ||
 		decoded[2].Key != ":path" || decoded[2].Value != "/index.html" ||
 		decoded[3].Key != ":authority" || decoded[3].Value != "www.example.com" ||
-		decoded[4].Key != "custom-Key" || decoded[4].Value != "custom-Value" {
-		t.Fatalf("Error DecodeHeader: want=::method: GET,:scheme: https,:path: /index.html,:authority: www.example.com,custom-Key: custom-Value, %v", decoded)
+		decoded[4].Key != "custom-key" || decoded[4].Value != "custom-value" {
+		t.Fatalf("Error DecodeHeader: want=::method: GET,:scheme: https,:path: /index.html,:authority: www.example.com,custom-key: custom-value, %v", decoded)
 	}
-	if con.DynamicTable[0].Key != "custom-Key" || con.DynamicTable[0].Value != "custom-Value" ||
+	if con.DynamicTable[0].Key != "custom-key" || con.DynamicTable[0].Value != "custom-value" ||
 		con.DynamicTable[1].Key != "cache-control" || con.DynamicTable[1].Value != "no-cache" ||
 		con.DynamicTable[2].Key != ":authority" || con.DynamicTable[2].Value != "www.example.com" {
-		t.Fatalf("Error DecodeHeader: want=:[{custom-Key custom-Value} {cache-control no-cache} {:authority www.example.com}], %v", con.DynamicTable)
+		t.Fatalf("Error DecodeHeader: want=:[{custom-key custom-value} {cache-control no-cache} {:authority www.example.com}], %v", con.DynamicTable)
 	}
 
 	// c4.1
 	encoded = []byte{0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff}
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 4096})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
 	if decoded[0].Key != ":method" || decoded[0].Value != "GET" ||
 		decoded[1].Key != ":scheme" || decoded[1].Value != "http" ||
 		decoded[2].Key != ":path" || decoded[2].Value != "/" ||
@@ -190,7 +200,7 @@ func TestDecodeHeader(t *testing.T) {
 
 	// c6.1
 	encoded = []byte{0x48, 0x82, 0x64, 0x02, 0x58, 0x85, 0xae, 0xc3, 0x77, 0x1a, 0x4b, 0x61, 0x96, 0xd0, 0x7a, 0xbe, 0x94, 0x10, 0x54, 0xd4, 0x44, 0xa8, 0x20, 0x05, 0x95, 0x04, 0x0b, 0x81, 0x66, 0xe0, 0x82, 0xa6, 0x2d, 0x1b, 0xff, 0x6e, 0x91, 0x9d, 0x29, 0xad, 0x17, 0x18, 0x63, 0xc7, 0x8f, 0x0b, 0x97, 0xc8, 0xe9, 0xae, 0x82, 0xae, 0x43, 0xd3}
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 4096})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
 
 	if decoded[0].Key != ":status" || decoded[0].Value != "302" ||
 		decoded[1].Key != "cache-control" || decoded[1].Value != "private" ||
@@ -207,12 +217,12 @@ func TestDecodeHeader(t *testing.T) {
 
 	// c6.1 + limit (len(location+https://www.example.com)+32=63)
 	encoded = []byte{0x48, 0x82, 0x64, 0x02, 0x58, 0x85, 0xae, 0xc3, 0x77, 0x1a, 0x4b, 0x61, 0x96, 0xd0, 0x7a, 0xbe, 0x94, 0x10, 0x54, 0xd4, 0x44, 0xa8, 0x20, 0x05, 0x95, 0x04, 0x0b, 0x81, 0x66, 0xe0, 0x82, 0xa6, 0x2d, 0x1b, 0xff, 0x6e, 0x91, 0x9d, 0x29, 0xad, 0x17, 0x18, 0x63, 0xc7, 0x8f, 0x0b, 0x97, 0xc8, 0xe9, 0xae, 0x82, 0xae, 0x43, 0xd3}
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 63})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 63})
 	if len(con.DynamicTable) != 1 {
 		t.Fatalf("Error DecodeHeader: want=1, ans=%v", len(con.DynamicTable))
 	}
 
-	decoded, con, _ = DecodeHeader(encoded, HpackConn{[]KeyValue{}, 62})
+	decoded, con, _ = DecodeHeader(encoded, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 62})
 	if len(con.DynamicTable) != 0 {
 		t.Fatalf("Error DecodeHeader: want=0, ans=%v", len(con.DynamicTable))
 	}
@@ -227,7 +237,7 @@ func TestEncodeHeader(t *testing.T) {
 		KeyValue{":path", "/"},
 		KeyValue{":authority", "www.example.com"},
 	}
-	b, con, _ := EncodeHeader(plain, HpackConn{[]KeyValue{}, 4096})
+	b, con, _ := EncodeHeader(plain, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
 	bHex := fmt.Sprintf("%#x", b)
 	if bHex != "0x828684418cf1e3c2e5f23a6ba0ab90f4ff" {
 		t.Fatalf("Error EncodeHeader: want=0x828684418cf1e3c2e5f23a6ba0ab90f4ff, ans=%v", bHex)
@@ -253,7 +263,7 @@ func TestEncodeHeader(t *testing.T) {
 		KeyValue{":scheme", "https"},
 		KeyValue{":path", "/index.html"},
 		KeyValue{":authority", "www.example.com"},
-		KeyValue{"custom-Key", "custom-Value"},
+		KeyValue{"custom-key", "custom-value"},
 	}
 
 	tmpCon := con
@@ -263,10 +273,10 @@ func TestEncodeHeader(t *testing.T) {
 	if bHex != "0x828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf" {
 		t.Fatalf("Error EncodeHeader: want=0x828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf, ans=%v", bHex)
 	}
-	if dh[0].Key != "custom-Key" || dh[0].Value != "custom-Value" ||
+	if dh[0].Key != "custom-key" || dh[0].Value != "custom-value" ||
 		dh[1].Key != "cache-control" || dh[1].Value != "no-cache" ||
 		dh[2].Key != ":authority" || dh[2].Value != "www.example.com" {
-		t.Fatalf("Error EncodeHeader: want=[{custom-Key custom-Value} {cache-control no-cache} {:authority www.example.com}], ans=%v", dh)
+		t.Fatalf("Error EncodeHeader: want=[{custom-key custom-value} {cache-control no-cache} {:authority www.example.com}], ans=%v", dh)
 	}
 
 	// c.4.3 + limit
@@ -282,3 +292,32 @@ func TestEncodeHeader(t *testing.T) {
 		t.Fatalf("Error DecodeHeader: want=1, ans=%v", len(dh))
 	}
 }
+
+func TestDynamicTableIntrospection(t *testing.T) {
+	// c.5: 8 entries are inserted, 5 of them are evicted
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 256}
+	for _, block := range appendixCaseNamed(t, "C.5").blocks {
+		_, con, _ = DecodeHeader(appendixWire(t, block.wire), con)
+	}
+	if con.Len() != 3 || con.Size() != 215 || con.MaxSize() != 256 {
+		t.Fatalf("Error Introspection: want=3, 215, 256, ans=%d, %d, %d", con.Len(), con.Size(), con.MaxSize())
+	}
+	entries := con.Entries()
+	if entries[0].Index != 62 || entries[0].Absolute != 8 || entries[0].Size != 98 || entries[0].Key != "set-cookie" ||
+		entries[2].Index != 64 || entries[2].Absolute != 6 || entries[2].Size != 65 || entries[2].Key != "date" {
+		t.Fatalf("Error Introspection: ans=%v", entries)
+	}
+
+	// c.3.3
+	con = HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	for _, block := range appendixCaseNamed(t, "C.3").blocks {
+		_, con, _ = DecodeHeader(appendixWire(t, block.wire), con)
+	}
+	want := "[  1] (s =  54) custom-key: custom-value\n" +
+		"[  2] (s =  53) cache-control: no-cache\n" +
+		"[  3] (s =  57) :authority: www.example.com\n" +
+		"      Table size: 164\n"
+	if con.String() != want {
+		t.Fatalf("Error Introspection: want=\n%s ans=\n%s", want, con.String())
+	}
+}
@@ -0,0 +1,59 @@
+package hpack
+
+import (
+	"bytes"
+	"errors"
+)
+
+// HuffmanDecoder decodes a huffman coded string given in fragments.
+// the bits of the current symbol survive between Write calls, so a string
+// cut in the middle (e.g. by CONTINUATION frames) can be decoded without
+// joining the fragments.
+//
+//  Write("\xf1\xe3") Write("\xc2\xe5\xf2\x3a") ... Finish() => "www.example.com"
+type HuffmanDecoder struct {
+	code    uint32 // bits of the current symbol (current node of the code tree)
+	codeLen int    // number of bits in code
+	buf     bytes.Buffer
+}
+
+// Write decodes p and keeps the bits of an incomplete symbol.
+func (h *HuffmanDecoder) Write(p []byte) (int, error) {
+	for _, c := range p {
+		for i := uint(8); i > 0; i-- {
+			h.code = h.code<<1 | uint32(c>>(i-1)&1)
+			h.codeLen++
+			// minimum length : 5
+			// maximum length : 30
+			if v, ok := huffmanDecodeTable[h.code]; ok && v.codeLen == h.codeLen {
+				h.buf.WriteByte(v.b)
+				h.code, h.codeLen = 0, 0
+				continue
+			}
+			if h.codeLen >= 30 {
+				return 0, errors.New("failed to decode huffman strings (can't find string)")
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Finish checks the padding and returns the decoded string.
+// the decoder is reset and can be used for the next string.
+//  5.2. padding is the most significant bits of EOS (all 1) and shorter than 8 bits
+func (h *HuffmanDecoder) Finish() (string, error) {
+	defer h.Reset()
+	if h.codeLen > 7 {
+		return "", errors.New("failed to decode huffman strings (too much eos)")
+	}
+	if h.code != 1<<uint(h.codeLen)-1 {
+		return "", errors.New("failed to decode huffman strings (wrong eos)")
+	}
+	return h.buf.String(), nil
+}
+
+// Reset discards the decoded bytes and the bits of the current symbol.
+func (h *HuffmanDecoder) Reset() {
+	h.code, h.codeLen = 0, 0
+	h.buf.Reset()
+}
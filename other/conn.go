@@ -0,0 +1,221 @@
+package minihttp2
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+	"./hpack"
+)
+
+// Role of the endpoint
+type Role uint8
+
+const (
+	RoleClient Role = iota
+	RoleServer
+)
+
+// Connection is an HTTP/2 connection over rw.
+// every endpoint has two dynamic tables (4.3. Header Compression and Decompression)
+//  sendHeaderCache:    used by the encoder (HEADERS we send)
+//  receiveHeaderCache: used by the decoder (HEADERS we receive)
+type Connection struct {
+	W    io.Writer
+	R    io.Reader
+	role Role
+
+	sendHeaderCache    hpack.HpackConn
+	receiveHeaderCache hpack.HpackConn
+
+	// SETTINGS
+	//  localSettings:  sent by this endpoint and acknowledged by the peer
+	//                  (changed by the goroutine reading frames with stateMu held)
+	//  remoteSettings: sent by the peer (guarded by mu)
+	localSettings  map[SettingsId]uint32
+	remoteSettings map[SettingsId]uint32
+
+	// SETTINGS sent by this endpoint and waiting for ACK (oldest first)
+	// the connection is closed with SETTINGS_TIMEOUT when ACK doesn't
+	// arrive within SettingsTimeout.
+	SettingsTimeout time.Duration
+	unackedSettings []*pendingSettings
+
+	// streams which are not closed (see stream.go)
+	//  lastPeerStreamID: the largest stream ID opened by the peer
+	//  resetStreams:     the latest streams closed by RST_STREAM of this endpoint
+	//                    (the frames received on them afterwards are ignored)
+	streams          map[uint32]*Stream
+	nextStreamID     uint32 // next stream ID opened by this endpoint
+	lastPeerStreamID uint32
+	resetStreams     []uint32
+
+	// GOAWAY (see goaway.go)
+	//  goingAway:        sent by this endpoint (Shutdown)
+	//  peerGoingAway:    received, peerLastStreamID is its last stream ID
+	goingAway        bool
+	peerGoingAway    bool
+	peerLastStreamID uint32
+
+	// flow control windows of the connection (see flow.go)
+	//  initialSendWindow: SETTINGS_INITIAL_WINDOW_SIZE of the peer
+	//  flowCond:          signaled when the send windows get credit
+	send              flow
+	recv              flow
+	initialSendWindow int64
+	flowCond          *sync.Cond
+
+	// when WINDOW_UPDATE is sent for received DATA (nil: UpdateAtHalf)
+	WindowUpdate WindowUpdateStrategy
+
+	// header block in progress (HEADERS + CONTINUATION)
+	continuation *headerBlock
+
+	// PING sent by Connection.Ping and waiting for ACK (key: Opaque Data)
+	pings   map[[8]byte]chan struct{}
+	pingSeq uint64
+
+	// Padding of DATA, HEADERS and PUSH_PROMISE written by this endpoint (nil: no padding)
+	Padding PaddingPolicy
+
+	// connection error which closed the connection
+	// closed is closed at the same time
+	err    error
+	closed chan struct{}
+
+	// mu: frames are written by several goroutines
+	//  (the send dynamic table and remoteSettings are changed with mu held)
+	// stateMu: unackedSettings, localSettings, streams, windows, GOAWAY, pings, err
+	mu      sync.Mutex
+	stateMu sync.Mutex
+}
+
+// Stream is a stream of the connection.
+type Stream struct {
+	ID uint32
+
+	con   *Connection
+	state StreamState // guarded by Connection.stateMu
+	err   error       // why the stream was closed (RST_STREAM, GOAWAY)
+
+	// flow control windows (guarded by Connection.stateMu)
+	send flow
+	recv flow
+}
+
+// 6.5.2. Defined SETTINGS Parameters (initial values)
+//  MAX_CONCURRENT_STREAMS and MAX_HEADER_LIST_SIZE are unlimited.
+func defaultSettings() map[SettingsId]uint32 {
+	return map[SettingsId]uint32{
+		HEADER_TABLE_SIZE:   4096,
+		ENABLE_PUSH:         1,
+		INITIAL_WINDOW_SIZE: 65535,
+		MAX_FRAME_SIZE:      DEFAULT_MAX_FRAME_SIZE,
+	}
+}
+
+// default SettingsTimeout
+const DEFAULT_SETTINGS_TIMEOUT = 10 * time.Second
+
+func newConnection(rw io.ReadWriter, role Role) *Connection {
+	con := &Connection{
+		W:               rw,
+		R:               rw,
+		role:            role,
+		localSettings:   defaultSettings(),
+		remoteSettings:  defaultSettings(),
+		SettingsTimeout: DEFAULT_SETTINGS_TIMEOUT,
+		streams:         map[uint32]*Stream{},
+		pings:           map[[8]byte]chan struct{}{},
+		closed:          make(chan struct{}),
+	}
+	con.send.window = DEFAULT_WINDOW_SIZE
+	con.recv.window = DEFAULT_WINDOW_SIZE
+	con.initialSendWindow = int64(con.remoteSettings[INITIAL_WINDOW_SIZE])
+	con.flowCond = sync.NewCond(&con.stateMu)
+	con.sendHeaderCache = hpack.HpackConn{DynamicTable: []hpack.KeyValue{}, TableSizeLimit: con.remoteSettings[HEADER_TABLE_SIZE]}
+	con.receiveHeaderCache = hpack.HpackConn{DynamicTable: []hpack.KeyValue{}, TableSizeLimit: con.localSettings[HEADER_TABLE_SIZE]}
+
+	// 5.1.1. Stream Identifiers
+	//  client: odd, server: even
+	if role == RoleClient {
+		con.nextStreamID = 1
+	} else {
+		con.nextStreamID = 2
+	}
+	return con
+}
+
+// NewClientConn returns a Connection of the client side.
+func NewClientConn(rw io.ReadWriter) *Connection {
+	return newConnection(rw, RoleClient)
+}
+
+// NewServerConn returns a Connection of the server side.
+func NewServerConn(rw io.ReadWriter) *Connection {
+	return newConnection(rw, RoleServer)
+}
+
+// Role returns the role of this endpoint.
+func (con *Connection) Role() Role {
+	return con.role
+}
+
+// NewStream returns a new idle stream with the next stream ID of this endpoint.
+// the stream is opened by HEADERS.
+func (con *Connection) NewStream() *Stream {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	s := con.newStream(con.nextStreamID)
+	con.nextStreamID += 2
+	return s
+}
+
+// Push promises a resource of header on the stream streamID opened by the
+// client, and returns the stream reserved for the response (8.4. Server Push).
+// an error is returned when the client disabled push (SETTINGS_ENABLE_PUSH = 0),
+// or the stream is not open (open or half-closed (remote)) as WritePushPromise,
+// i.e. StreamError for an idle stream and ErrStreamClosed for a closed one.
+func (con *Connection) Push(streamID uint32, header []hpack.KeyValue) (*Stream, error) {
+	if con.role != RoleServer {
+		return nil, errors.New("Push: only the server can push")
+	}
+	if streamID == 0 || streamID % 2 == 0 {
+		return nil, errors.New("Push: the associated stream must be opened by the client")
+	}
+
+	// the promised stream ID is allocated while holding mu,
+	// so that the IDs are written in increasing order
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	if con.remoteSettings[ENABLE_PUSH] == 0 {
+		return nil, errors.New("Push: push is disabled by the client")
+	}
+	s := con.NewStream()
+	if err := con.writePushPromise(&Framer{StreamID: streamID}, PushPromise{PromisedID: s.ID, Header: header}); err != nil {
+		// the promised stream ID is skipped (5.1.1.)
+		con.stateMu.Lock()
+		con.closeStream(s)
+		con.stateMu.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stream returns the stream of id (nil if the stream is not known or closed).
+func (con *Connection) Stream(id uint32) *Stream {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	return con.streams[id]
+}
+
+// write writes b to W.
+// a frame is written by one Write call while holding the lock,
+// so that frames of different goroutines are not mixed.
+func (con *Connection) write(b []byte) error {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	_, err := con.W.Write(b)
+	return err
+}
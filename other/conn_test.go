@@ -0,0 +1,120 @@
+package minihttp2
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"./hpack"
+)
+
+func TestNewConn(t *testing.T) {
+	client := NewClientConn(&bytes.Buffer{})
+	server := NewServerConn(&bytes.Buffer{})
+	if client.Role() != RoleClient || server.Role() != RoleServer {
+		t.Fatalf("Error: Role client=%v server=%v", client.Role(), server.Role())
+	}
+	for i, want := range []uint32{1, 3, 5} {
+		if s := client.NewStream(); s.ID != want || client.Stream(want) != s {
+			t.Fatalf("Error: client stream %d want=%d, ans=%d", i, want, s.ID)
+		}
+	}
+	for i, want := range []uint32{2, 4, 6} {
+		if s := server.NewStream(); s.ID != want || server.Stream(want) != s {
+			t.Fatalf("Error: server stream %d want=%d, ans=%d", i, want, s.ID)
+		}
+	}
+	if client.maxFrameSize() != DEFAULT_MAX_FRAME_SIZE || client.sendHeaderCache.MaxSize() != 4096 {
+		t.Fatalf("Error: default settings %v", client.remoteSettings)
+	}
+}
+
+// HEADERS written by the client are decoded by the server
+func TestConnHeaders(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	server := NewServerConn(&bytes.Buffer{})
+
+	// written concurrently, every block must be decodable in the written order
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := client.NewStream()
+			header := []hpack.KeyValue{
+				{Key: ":method", Value: "GET"},
+				{Key: ":path", Value: fmt.Sprintf("/%d", i)},
+				{Key: "x-stream", Value: fmt.Sprint(s.ID)},
+			}
+			if err := WriteHeader(client, &Framer{StreamID: s.ID}, header); err != nil {
+				t.Errorf("Error: WriteHeader %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 20 {
+		t.Fatalf("Error: want 20 frames, ans=%d", len(frames))
+	}
+	for i := range frames {
+		v, err := server.ParseFrame(&frames[i], payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseFrame %v", err)
+		}
+		h := v.(*Header)
+		if len(h.Header) != 3 || h.Header[2].Value != fmt.Sprint(frames[i].StreamID) {
+			t.Fatalf("Error: ParseFrame stream %d: %v", frames[i].StreamID, h.Header)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	wire := &bytes.Buffer{}
+	server := NewServerConn(wire)
+	client := NewClientConn(&bytes.Buffer{})
+	header := []hpack.KeyValue{{Key: ":method", Value: "GET"}, {Key: ":path", Value: "/style.css"}}
+	openStream(t, server, 1)
+
+	for _, want := range []uint32{2, 4} {
+		s, err := server.Push(1, header)
+		if err != nil || s.ID != want || server.Stream(want) != s {
+			t.Fatalf("Error: Push want=%d, ans=%v %v", want, s, err)
+		}
+	}
+	frames, payloads := splitFrames(t, wire.Bytes())
+	for i, want := range []uint32{2, 4} {
+		v, err := client.ParseFrame(&frames[i], payloads[i])
+		pp, ok := v.(*PushPromise)
+		if err != nil || !ok || frames[i].StreamID != 1 || pp.PromisedID != want || len(pp.Header) != 2 {
+			t.Fatalf("Error: ParseFrame PUSH_PROMISE %+v %v", v, err)
+		}
+	}
+
+	// only the server pushes, on a stream opened by the client, when push is enabled
+	if _, err := client.Push(1, header); err == nil {
+		t.Fatalf("Error: Push by the client")
+	}
+	if _, err := server.Push(2, header); err == nil {
+		t.Fatalf("Error: Push on the server's stream")
+	}
+	n := wire.Len()
+	_, err := server.Push(3, header)
+	if e, ok := err.(StreamError); !ok || e.StreamID != 3 || e.Code != PROTOCOL_ERROR || wire.Len() != n {
+		t.Fatalf("Error: Push on the stream not opened by the client %v", err)
+	}
+	server.receiveFrame(&Framer{StreamID: 1}, &RstStream{CANCEL})
+	if _, err := server.Push(1, header); err != ErrStreamClosed || wire.Len() != n {
+		t.Fatalf("Error: Push on the closed stream %v", err)
+	}
+	// the promised streams of the failed pushes are not left idle
+	if s := server.Stream(6); s != nil {
+		t.Fatalf("Error: promised stream of the failed Push %s", s.State())
+	}
+	openStream(t, server, 5)
+	server.remoteSettings[ENABLE_PUSH] = 0
+	if _, err := server.Push(5, header); err == nil {
+		t.Fatalf("Error: Push while SETTINGS_ENABLE_PUSH is 0")
+	}
+}
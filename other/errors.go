@@ -0,0 +1,42 @@
+package minihttp2
+
+import (
+	"fmt"
+)
+
+// 5.4.1. Connection Error Handling
+//  the endpoint sends GOAWAY with Code and closes the connection.
+type ConnectionError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error: %s: %s", e.Code, e.Reason)
+}
+
+// 5.4.2. Stream Error Handling
+//  the endpoint sends RST_STREAM with Code, the connection is kept.
+type StreamError struct {
+	StreamID uint32
+	Code     ErrorCode
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream error: stream %d: %s: %s", e.StreamID, e.Code, e.Reason)
+}
+
+// ErrorCodeOf tells how err is reported to the peer.
+//  StreamError:     RST_STREAM on streamID (stream == true)
+//  ConnectionError: GOAWAY
+//  other errors:    GOAWAY with INTERNAL_ERROR
+func ErrorCodeOf(err error) (code ErrorCode, streamID uint32, stream bool) {
+	switch e := err.(type) {
+	case StreamError:
+		return e.Code, e.StreamID, true
+	case ConnectionError:
+		return e.Code, 0, false
+	}
+	return INTERNAL_ERROR, 0, false
+}
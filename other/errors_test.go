@@ -0,0 +1,50 @@
+package minihttp2
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorCodeString(t *testing.T) {
+	for code, want := range map[ErrorCode]string{
+		NO_ERROR:          "NO_ERROR",
+		PROTOCOL_ERROR:    "PROTOCOL_ERROR",
+		COMPRESSION_ERROR: "COMPRESSION_ERROR",
+		HTTP_1_1_REQUIRED: "HTTP_1_1_REQUIRED",
+		0xff:              "unknown error code 0xff",
+	} {
+		if code.String() != want {
+			t.Fatalf("Error: ErrorCode.String want=%s, ans=%s", want, code.String())
+		}
+	}
+
+	err := error(ConnectionError{FRAME_SIZE_ERROR, "too long"})
+	if err.Error() != "connection error: FRAME_SIZE_ERROR: too long" {
+		t.Fatalf("Error: ConnectionError %s", err)
+	}
+	err = StreamError{3, REFUSED_STREAM, "refused"}
+	if err.Error() != "stream error: stream 3: REFUSED_STREAM: refused" {
+		t.Fatalf("Error: StreamError %s", err)
+	}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	code, id, stream := ErrorCodeOf(StreamError{5, CANCEL, ""})
+	if code != CANCEL || id != 5 || !stream {
+		t.Fatalf("Error: ErrorCodeOf StreamError %v %d %v", code, id, stream)
+	}
+	code, _, stream = ErrorCodeOf(ConnectionError{PROTOCOL_ERROR, ""})
+	if code != PROTOCOL_ERROR || stream {
+		t.Fatalf("Error: ErrorCodeOf ConnectionError %v %v", code, stream)
+	}
+	code, _, stream = ErrorCodeOf(errors.New("unknown"))
+	if code != INTERNAL_ERROR || stream {
+		t.Fatalf("Error: ErrorCodeOf error %v %v", code, stream)
+	}
+
+	// errors of the parser
+	_, err := ParseRstStream(&Framer{FType: FrameRSTStream}, make([]byte, 4))
+	if code, _, stream := ErrorCodeOf(err); code != PROTOCOL_ERROR || stream {
+		t.Fatalf("Error: ErrorCodeOf ParseRstStream %v %v", code, stream)
+	}
+}
@@ -0,0 +1,235 @@
+package minihttp2
+
+import (
+	"fmt"
+)
+
+// 5.2. Flow Control / 6.9. WINDOW_UPDATE
+//
+//  send:    DATA is written only within the windows of the connection and
+//           the stream, WriteData blocks until WINDOW_UPDATE gives credit.
+//  receive: DATA exceeding the windows is FLOW_CONTROL_ERROR, and the
+//           credit is returned by WINDOW_UPDATE (WindowUpdateStrategy)
+//           after the frame is handled.
+//
+// the whole DATA payload (including Pad Length and Padding) is counted.
+// every window is guarded by stateMu.
+
+// 6.9.1. The maximum window size is 2^31-1
+const MAX_WINDOW_SIZE = 1<<31 - 1
+
+// 6.9.2. initial window size of the connection
+//  (SETTINGS_INITIAL_WINDOW_SIZE applies to the streams only)
+const DEFAULT_WINDOW_SIZE = 65535
+
+// flow is a window of one direction.
+type flow struct {
+	window   int64 // available credit (can be negative after SETTINGS_INITIAL_WINDOW_SIZE is reduced)
+	consumed int64 // received and handled, but not returned by WINDOW_UPDATE yet
+}
+
+// add adds n to the window, false is returned when the window exceeds 2^31-1.
+func (f *flow) add(n int64) bool {
+	if f.window+n > MAX_WINDOW_SIZE {
+		return false
+	}
+	f.window += n
+	return true
+}
+
+// WindowUpdateStrategy decides when the credit of received DATA is returned.
+// consumed: octets handled but not returned yet, size: the initial window size.
+// WINDOW_UPDATE with consumed octets is sent when it returns true.
+type WindowUpdateStrategy func(consumed, size int64) bool
+
+// UpdateImmediately returns the credit after every DATA frame.
+func UpdateImmediately(consumed, size int64) bool {
+	return consumed > 0
+}
+
+// UpdateAtHalf returns the credit when half of the window is consumed (default).
+func UpdateAtHalf(consumed, size int64) bool {
+	return consumed > 0 && consumed >= size/2
+}
+
+// newStream adds the idle stream of id with the initial windows.
+// stateMu must be held.
+func (con *Connection) newStream(id uint32) *Stream {
+	s := &Stream{
+		ID:   id,
+		con:  con,
+		send: flow{window: con.initialSendWindow},
+		recv: flow{window: int64(con.localSettings[INITIAL_WINDOW_SIZE])},
+	}
+	con.streams[id] = s
+	return s
+}
+
+// reserveSend waits until the connection and the stream of id have credit,
+// and takes at most n octets (at least min octets) from both windows.
+// DATA can be sent on open or half-closed (remote) stream.
+func (con *Connection) reserveSend(id uint32, n, min int) (int, error) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	s, state := con.lookup(id)
+	switch state {
+	case StateIdle:
+		return 0, fmt.Errorf("DATA on idle stream %d", id)
+	case StateOpen, StateHalfClosedRemote:
+	default:
+		if s != nil && s.err != nil {
+			return 0, s.err
+		}
+		return 0, ErrStreamClosed
+	}
+	for {
+		if con.err != nil {
+			return 0, con.err
+		}
+		if s.state == StateClosed {
+			// RST_STREAM or GOAWAY while waiting
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, ErrStreamClosed
+		}
+		avail := con.send.window
+		if s.send.window < avail {
+			avail = s.send.window
+		}
+		if avail >= int64(min) {
+			if int64(n) > avail {
+				n = int(avail)
+			}
+			con.send.window -= int64(n)
+			s.send.window -= int64(n)
+			return n, nil
+		}
+		con.flowCond.Wait()
+	}
+}
+
+// releaseSend gives back n octets taken by reserveSend but not sent.
+func (con *Connection) releaseSend(id uint32, n int) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	con.send.window += int64(n)
+	if s, ok := con.streams[id]; ok {
+		s.send.window += int64(n)
+	}
+	con.flowCond.Broadcast()
+}
+
+// handleWindowUpdate adds the increment to the window of the connection
+// (stream ID 0) or the stream, and wakes up the blocked writers.
+func (con *Connection) handleWindowUpdate(f *Framer, wu *WindowUpdate) error {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	if f.StreamID == 0 {
+		if !con.send.add(int64(wu.WindowSizeIncrement)) {
+			return ConnectionError{FLOW_CONTROL_ERROR, "connection window exceeds 2^31-1"}
+		}
+	} else if s, ok := con.streams[f.StreamID]; ok && !s.send.add(int64(wu.WindowSizeIncrement)) {
+		// WINDOW_UPDATE on a closed stream is ignored
+		return StreamError{f.StreamID, FLOW_CONTROL_ERROR, "stream window exceeds 2^31-1"}
+	}
+	con.flowCond.Broadcast()
+	return nil
+}
+
+// receiveData takes the DATA payload from the receive windows.
+func (con *Connection) receiveData(f *Framer) error {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	n := int64(f.Length)
+	if con.recv.window < n {
+		return ConnectionError{FLOW_CONTROL_ERROR, "DATA exceeds the connection window"}
+	}
+	con.recv.window -= n
+	if s, ok := con.streams[f.StreamID]; ok {
+		if s.recv.window < n {
+			return StreamError{f.StreamID, FLOW_CONTROL_ERROR, "DATA exceeds the stream window"}
+		}
+		s.recv.window -= n
+	}
+	return nil
+}
+
+// consumeData returns the credit of the handled DATA by WINDOW_UPDATE
+// according to WindowUpdate. the stream isn't updated after END_STREAM
+// (or when the stream is closed).
+func (con *Connection) consumeData(f *Framer, eos bool) error {
+	strategy := con.WindowUpdate
+	if strategy == nil {
+		strategy = UpdateAtHalf
+	}
+
+	var connInc, streamInc int64
+	con.stateMu.Lock()
+	s, ok := con.streams[f.StreamID]
+	con.recv.consumed += int64(f.Length)
+	if strategy(con.recv.consumed, DEFAULT_WINDOW_SIZE) {
+		connInc = con.recv.consumed
+		con.recv.window += connInc
+		con.recv.consumed = 0
+	}
+	if ok && !eos {
+		s.recv.consumed += int64(f.Length)
+		if strategy(s.recv.consumed, int64(con.localSettings[INITIAL_WINDOW_SIZE])) {
+			streamInc = s.recv.consumed
+			s.recv.window += streamInc
+			s.recv.consumed = 0
+		}
+	}
+	con.stateMu.Unlock()
+
+	if connInc > 0 {
+		if err := WriteWindowUpdate(con, &Framer{}, uint32(connInc)); err != nil {
+			return err
+		}
+	}
+	if streamInc > 0 {
+		return WriteWindowUpdate(con, &Framer{StreamID: f.StreamID}, uint32(streamInc))
+	}
+	return nil
+}
+
+// discardData returns the connection credit of DATA which is not handled
+// because of err (e.g. on a closed stream), and returns err.
+// the stream window is not updated, and nothing is returned for a connection error.
+func (con *Connection) discardData(f *Framer, err error) error {
+	if _, ok := err.(ConnectionError); ok {
+		return err
+	}
+	if e := con.consumeData(f, true); e != nil {
+		return e
+	}
+	return err
+}
+
+// 6.9.2. Initial Flow-Control Window Size
+//  a change of SETTINGS_INITIAL_WINDOW_SIZE is applied to all the streams
+//  by the difference, a window exceeding 2^31-1 is FLOW_CONTROL_ERROR.
+//  stateMu must be held.
+func (con *Connection) setInitialSendWindow(size uint32) error {
+	delta := int64(size) - con.initialSendWindow
+	con.initialSendWindow = int64(size)
+	for _, s := range con.streams {
+		if !s.send.add(delta) {
+			return ConnectionError{FLOW_CONTROL_ERROR, "stream window exceeds 2^31-1"}
+		}
+	}
+	con.flowCond.Broadcast()
+	return nil
+}
+
+// setInitialRecvWindow applies the change of our SETTINGS_INITIAL_WINDOW_SIZE
+// to the receive windows, stateMu must be held.
+func (con *Connection) setInitialRecvWindow(old, size uint32) {
+	for _, s := range con.streams {
+		s.recv.window += int64(size) - int64(old)
+	}
+}
@@ -0,0 +1,280 @@
+package minihttp2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"./hpack"
+)
+
+func TestFlowControl(t *testing.T) {
+	client, server := connPair(t)
+
+	body := make(chan string, 1)
+	received := ""
+	serve(server, func(f *Framer, v interface{}) error {
+		if d, ok := v.(*Data); ok {
+			received += string(d.Content)
+			if d.Eos {
+				body <- received
+			}
+		}
+		return nil
+	})
+	serve(client, nil)
+
+	// larger than the initial windows (65535), WINDOW_UPDATE from the server is needed
+	data := strings.Repeat("0123456789", 20000)
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, []hpack.KeyValue{{Key: ":method", Value: "POST"}}, WithEndStream(false))
+	if err := WriteData(client, &Framer{StreamID: s.ID}, []byte(data)); err != nil {
+		t.Fatalf("Error: WriteData %v", err)
+	}
+	select {
+	case b := <-body:
+		if b != data {
+			t.Fatalf("Error: received %d octets, want=%d", len(b), len(data))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: DATA not received")
+	}
+}
+
+func TestFlowControlBlock(t *testing.T) {
+	client, server := connPair(t)
+	// the server never returns the credit by itself
+	server.WindowUpdate = func(consumed, size int64) bool { return false }
+	serve(server, nil)
+	serve(client, nil)
+
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, []hpack.KeyValue{{Key: ":method", Value: "POST"}}, WithEndStream(false))
+	done := make(chan error, 1)
+	go func() {
+		done <- WriteData(client, &Framer{StreamID: s.ID}, make([]byte, DEFAULT_WINDOW_SIZE+100))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Error: WriteData didn't block %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// credit of the connection only is not enough, the stream window is also needed
+	WriteWindowUpdate(server, &Framer{}, 100)
+	select {
+	case err := <-done:
+		t.Fatalf("Error: WriteData didn't block %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	WriteWindowUpdate(server, &Framer{StreamID: s.ID}, 100)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Error: WriteData %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: WriteData blocked")
+	}
+}
+
+func TestInitialWindowSize(t *testing.T) {
+	client, server := connPair(t)
+	serve(server, nil)
+	serve(client, nil)
+
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, []hpack.KeyValue{{Key: ":method", Value: "POST"}}, WithEndStream(false))
+	WriteData(client, &Framer{StreamID: s.ID}, make([]byte, 1000), WithEndStream(false))
+
+	// applied to the open stream by the difference (65535 - 1000 + (100000 - 65535))
+	if err := server.SendSettings(Setting{INITIAL_WINDOW_SIZE, 100000}); err != nil {
+		t.Fatalf("Error: SendSettings %v", err)
+	}
+	waitUntil(t, func() bool { return server.PendingSettings() == 0 })
+	client.stateMu.Lock()
+	window := client.streams[s.ID].send.window
+	client.stateMu.Unlock()
+	if window != 99000 {
+		t.Fatalf("Error: stream window want=99000, ans=%d", window)
+	}
+
+	// and the receive window of the server
+	server.stateMu.Lock()
+	window = server.streams[s.ID].recv.window
+	server.stateMu.Unlock()
+	if window != 99000 {
+		t.Fatalf("Error: server stream window want=99000, ans=%d", window)
+	}
+}
+
+// openStream opens the stream id of the peer as if HEADERS was received.
+func openStream(t *testing.T, con *Connection, id uint32) {
+	if err := con.receiveFrame(&Framer{FType: FrameHeaders, StreamID: id}, &Header{}); err != nil {
+		t.Fatalf("Error: open stream %d %v", id, err)
+	}
+}
+
+// openLocalStream opens the stream of con as HEADERS were written.
+func openLocalStream(t *testing.T, con *Connection, id uint32) {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	if err := con.sendHeaders(id, false); err != nil {
+		t.Fatalf("Error: open stream %d %v", id, err)
+	}
+}
+
+func TestFlowControlError(t *testing.T) {
+	con := NewServerConn(&bytes.Buffer{})
+	openStream(t, con, 1)
+
+	// 6.9.1. window exceeding 2^31-1
+	err := con.handleWindowUpdate(&Framer{}, &WindowUpdate{MAX_WINDOW_SIZE})
+	if e, ok := err.(ConnectionError); !ok || e.Code != FLOW_CONTROL_ERROR {
+		t.Fatalf("Error: connection window want=FLOW_CONTROL_ERROR, ans=%v", err)
+	}
+	err = con.handleWindowUpdate(&Framer{StreamID: 1}, &WindowUpdate{MAX_WINDOW_SIZE})
+	if e, ok := err.(StreamError); !ok || e.Code != FLOW_CONTROL_ERROR || e.StreamID != 1 {
+		t.Fatalf("Error: stream window want=FLOW_CONTROL_ERROR, ans=%v", err)
+	}
+	// stream 1 has 10 octets more than the initial window
+	if err := con.handleWindowUpdate(&Framer{StreamID: 1}, &WindowUpdate{10}); err != nil {
+		t.Fatalf("Error: WINDOW_UPDATE %v", err)
+	}
+	con.stateMu.Lock()
+	err = con.setInitialSendWindow(MAX_WINDOW_SIZE)
+	con.stateMu.Unlock()
+	if e, ok := err.(ConnectionError); !ok || e.Code != FLOW_CONTROL_ERROR {
+		t.Fatalf("Error: INITIAL_WINDOW_SIZE want=FLOW_CONTROL_ERROR, ans=%v", err)
+	}
+
+	// DATA exceeding the receive windows
+	con = NewServerConn(&bytes.Buffer{})
+	con.localSettings[INITIAL_WINDOW_SIZE] = 100
+	openStream(t, con, 3)
+	err = con.receiveData(&Framer{Length: 101, StreamID: 3})
+	if e, ok := err.(StreamError); !ok || e.Code != FLOW_CONTROL_ERROR {
+		t.Fatalf("Error: stream receive window want=FLOW_CONTROL_ERROR, ans=%v", err)
+	}
+	con.localSettings[INITIAL_WINDOW_SIZE] = 1 << 20
+	openStream(t, con, 5)
+	err = con.receiveData(&Framer{Length: DEFAULT_WINDOW_SIZE + 1, StreamID: 5})
+	if e, ok := err.(ConnectionError); !ok || e.Code != FLOW_CONTROL_ERROR {
+		t.Fatalf("Error: connection receive window want=FLOW_CONTROL_ERROR, ans=%v", err)
+	}
+
+	// the credit is returned by the strategy
+	wire := &bytes.Buffer{}
+	con = NewServerConn(wire)
+	con.WindowUpdate = UpdateImmediately
+	openStream(t, con, 1)
+	f := &Framer{Length: 10, StreamID: 1}
+	if err := con.receiveData(f); err != nil {
+		t.Fatalf("Error: receiveData %v", err)
+	}
+	if err := con.consumeData(f, false); err != nil {
+		t.Fatalf("Error: consumeData %v", err)
+	}
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 2 || frames[0].StreamID != 0 || frames[1].StreamID != 1 {
+		t.Fatalf("Error: WINDOW_UPDATE %+v", frames)
+	}
+	for i := range frames {
+		if wu, err := ParseWindowUpdate(&frames[i], payloads[i]); err != nil || wu.WindowSizeIncrement != 10 {
+			t.Fatalf("Error: WINDOW_UPDATE %+v %v", wu, err)
+		}
+	}
+}
+
+func TestDataOnClosedStream(t *testing.T) {
+	wire := &bytes.Buffer{}
+	server := NewServerConn(wire)
+	server.WindowUpdate = UpdateImmediately
+	h := func(f *Framer, v interface{}) error {
+		t.Fatalf("Error: DATA on closed stream %d is handled", f.StreamID)
+		return nil
+	}
+	openStream(t, server, 1)
+	openStream(t, server, 3)
+	WriteRstStream(server, &Framer{StreamID: 1}, CANCEL)
+	server.receiveFrame(&Framer{StreamID: 3}, &Data{Eos: true})
+	WriteHeader(server, &Framer{StreamID: 3}, []hpack.KeyValue{{Key: ":status", Value: "200"}})
+	wire.Reset()
+
+	// reset by the server: ignored, stream 3 closed normally: STREAM_CLOSED
+	f := &Framer{Length: 10, FType: FrameData, StreamID: 1}
+	if err := server.handleFrame(f, &Data{Content: make([]byte, 10)}, h); err != nil {
+		t.Fatalf("Error: DATA on reset stream %v", err)
+	}
+	f = &Framer{Length: 20, FType: FrameData, StreamID: 3}
+	err := server.handleFrame(f, &Data{Content: make([]byte, 20)}, h)
+	if e, ok := err.(StreamError); !ok || e.Code != STREAM_CLOSED {
+		t.Fatalf("Error: DATA on closed stream want=STREAM_CLOSED, ans=%v", err)
+	}
+
+	// the credit of the connection is returned in both cases
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 2 {
+		t.Fatalf("Error: want 2 WINDOW_UPDATE, ans=%+v", frames)
+	}
+	for i, want := range []uint32{10, 20} {
+		wu, err := ParseWindowUpdate(&frames[i], payloads[i])
+		if err != nil || frames[i].StreamID != 0 || wu.WindowSizeIncrement != want {
+			t.Fatalf("Error: WINDOW_UPDATE %+v %+v %v", frames[i], wu, err)
+		}
+	}
+	server.stateMu.Lock()
+	window := server.recv.window
+	server.stateMu.Unlock()
+	if window != DEFAULT_WINDOW_SIZE {
+		t.Fatalf("Error: connection window want=%d, ans=%d", DEFAULT_WINDOW_SIZE, window)
+	}
+
+	// the other frames on the reset stream are ignored too
+	if err := server.receiveFrame(&Framer{StreamID: 1}, &Header{}); err != errStreamReset {
+		t.Fatalf("Error: HEADERS on reset stream %v", err)
+	}
+}
+
+func TestDataHandlerError(t *testing.T) {
+	wire := &bytes.Buffer{}
+	server := NewServerConn(wire)
+	server.WindowUpdate = UpdateImmediately
+	h := func(f *Framer, v interface{}) error {
+		return StreamError{f.StreamID, INTERNAL_ERROR, "handler failed"}
+	}
+	openStream(t, server, 1)
+	wire.Reset()
+
+	// the connection credit is returned though h fails
+	f := &Framer{Length: 30, FType: FrameData, StreamID: 1}
+	if err := server.handleFrame(f, &Data{Content: make([]byte, 30)}, h); err == nil {
+		t.Fatalf("Error: handleFrame doesn't return the error of h")
+	}
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 1 || frames[0].StreamID != 0 {
+		t.Fatalf("Error: want 1 WINDOW_UPDATE of the connection, ans=%+v", frames)
+	}
+	if wu, err := ParseWindowUpdate(&frames[0], payloads[0]); err != nil || wu.WindowSizeIncrement != 30 {
+		t.Fatalf("Error: WINDOW_UPDATE %+v %v", wu, err)
+	}
+	server.stateMu.Lock()
+	window := server.recv.window
+	server.stateMu.Unlock()
+	if window != DEFAULT_WINDOW_SIZE {
+		t.Fatalf("Error: connection window want=%d, ans=%d", DEFAULT_WINDOW_SIZE, window)
+	}
+}
+
+func TestWriteDataIdle(t *testing.T) {
+	// DATA can't open a stream
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	s := client.NewStream()
+	if err := WriteData(client, &Framer{StreamID: s.ID}, []byte("hello")); err == nil || wire.Len() != 0 {
+		t.Fatalf("Error: WriteData on idle stream %v", err)
+	}
+	if s.State() != StateIdle {
+		t.Fatalf("Error: stream want=idle, ans=%s", s.State())
+	}
+}
@@ -2,10 +2,10 @@ package minihttp2
 
 import (
 	"io"
+	"fmt"
 	"encoding/binary"
 	"./hpack"
 	"errors"
-	"bytes"
 )
 
 
@@ -50,22 +50,47 @@ var frameName = map[FrameType]string{
 // Error Code (used by RST_STREAM and GOAWAY)
 type ErrorCode uint32
 const (
-	NO_ERROR          ErrorCode  = 0x0
-	PROTOCOL_ERROR      = 0x1
-	INTERNAL_ERROR      = 0x2
-	FLOW_CONTROL_ERROR  = 0x3
-	SETTINGS_TIMEOUT    = 0x4
-	STREAM_CLOSED       = 0x5
-	FRAME_SIZE_ERROR    = 0x6
-	REFUSED_STREAM      = 0x7
-	CANCEL              = 0x8
-	COMPRESSION_ERROR   = 0x9
-	CONNECT_ERROR       = 0xa
-	ENHANCE_YOUR_CALM   = 0xb
-	INADEQUATE_SECURITY = 0xc
-	HTTP_1_1_REQUIRED   = 0xd
+	NO_ERROR            ErrorCode = 0x0
+	PROTOCOL_ERROR      ErrorCode = 0x1
+	INTERNAL_ERROR      ErrorCode = 0x2
+	FLOW_CONTROL_ERROR  ErrorCode = 0x3
+	SETTINGS_TIMEOUT    ErrorCode = 0x4
+	STREAM_CLOSED       ErrorCode = 0x5
+	FRAME_SIZE_ERROR    ErrorCode = 0x6
+	REFUSED_STREAM      ErrorCode = 0x7
+	CANCEL              ErrorCode = 0x8
+	COMPRESSION_ERROR   ErrorCode = 0x9
+	CONNECT_ERROR       ErrorCode = 0xa
+	ENHANCE_YOUR_CALM   ErrorCode = 0xb
+	INADEQUATE_SECURITY ErrorCode = 0xc
+	HTTP_1_1_REQUIRED   ErrorCode = 0xd
 )
 
+var errorCodeName = map[ErrorCode]string{
+	NO_ERROR:            "NO_ERROR",
+	PROTOCOL_ERROR:      "PROTOCOL_ERROR",
+	INTERNAL_ERROR:      "INTERNAL_ERROR",
+	FLOW_CONTROL_ERROR:  "FLOW_CONTROL_ERROR",
+	SETTINGS_TIMEOUT:    "SETTINGS_TIMEOUT",
+	STREAM_CLOSED:       "STREAM_CLOSED",
+	FRAME_SIZE_ERROR:    "FRAME_SIZE_ERROR",
+	REFUSED_STREAM:      "REFUSED_STREAM",
+	CANCEL:              "CANCEL",
+	COMPRESSION_ERROR:   "COMPRESSION_ERROR",
+	CONNECT_ERROR:       "CONNECT_ERROR",
+	ENHANCE_YOUR_CALM:   "ENHANCE_YOUR_CALM",
+	INADEQUATE_SECURITY: "INADEQUATE_SECURITY",
+	HTTP_1_1_REQUIRED:   "HTTP_1_1_REQUIRED",
+}
+
+// 7. unknown error codes must not trigger any special behavior
+func (e ErrorCode) String() string {
+	if n, ok := errorCodeName[e]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(e))
+}
+
 
 
 
@@ -106,6 +131,19 @@ func (f *Framer) writeFrame(w io.Writer) error {
 	return nil
 }
 
+// putFrameHeader fills the first 9 octets of b with the frame header.
+func (f *Framer) putFrameHeader(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], (f.Length << 8) + uint32(f.FType))
+	b[4] = f.Flags
+	binary.BigEndian.PutUint32(b[5:9], f.StreamID)
+}
+
+func (f *Framer) appendFrameHeader(dst []byte) []byte {
+	var h [9]byte
+	f.putFrameHeader(h[:])
+	return append(dst, h[:]...)
+}
+
 type NotEnoughByte struct{
 }
 
@@ -120,10 +158,10 @@ func ReadFrame(b []byte) (*Framer, []byte, []byte, error) {
 	}
 	// read length + Type
 	frame := &Framer{
-		Length:   uint32(b[0]<<16 | b[1]<<8 | b[2]),
+		Length:   binary.BigEndian.Uint32(b[0:4]) >> 8,
 		FType:    FrameType(b[3]),
 		Flags:    uint8(b[4]),
-		StreamID: uint32(b[5]<<24|b[6]<<16|b[7]<<8|b[8]) & (1<<31 - 1), // 1 << 31 -1 equal 0111111... (this purpose is to change first bit to zero)
+		StreamID: binary.BigEndian.Uint32(b[5:9]) & (1<<31 - 1), // 1 << 31 -1 equal 0111111... (this purpose is to change first bit to zero)
 	}
 	if uint32(len(b)) < frame.Length + 9 {
 		return nil, nil, nil, NotEnoughByte{}
@@ -154,37 +192,103 @@ const (
 	DATA_PADDED = 0x8
 )
 
-// Memo: 必ずEND STREAMになるようになってる。
-func WriteData(con *Connection, frame *Framer, data []byte) error {
-	wBuffer := bytes.Buffer{}
+// END_STREAM is set unless WithEndStream(false).
+// padding: WithPadding / WithPaddingPolicy, or Connection.Padding
+//
+// data is split into frames of at most SETTINGS_MAX_FRAME_SIZE of the peer,
+// and every frame waits for the credit of flow control (see flow.go).
+// END_STREAM is set on the last frame only.
+func WriteData(con *Connection, frame *Framer, data []byte, opts ...WriteOption) error {
+	o := con.writeOptions(opts)
+
+	for {
+		con.mu.Lock()
+		max := int(con.maxFrameSize())
+		con.mu.Unlock()
+
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		// Pad Length + Padding are counted in the frame and the windows
+		n, pad := o.fitPadding(n, max)
+		size := n + padLength(pad)
+
+		// empty DATA (e.g. only END_STREAM) needs no credit
+		if size > 0 {
+			// at least the padded chunk of 1 octet
+			min := size
+			if n > 0 {
+				if m := 1 + padLength(o.paddingFor(1)); m < min {
+					min = m
+				}
+			}
+			got, err := con.reserveSend(frame.StreamID, size, min)
+			if err != nil {
+				return err
+			}
+			// the chunk is cut to the credit and padded again,
+			// the credit not used by the padded chunk is given back
+			if got < size {
+				n, pad = o.fitPadding(n, got)
+				if rest := got - n - padLength(pad); rest > 0 {
+					con.releaseSend(frame.StreamID, rest)
+				}
+			}
+		}
+
+		end := o.endStream && n == len(data)
+		if err := con.writeData(frame, data[:n], pad, end); err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			if end {
+				con.sendEndStream(frame.StreamID)
+			}
+			return nil
+		}
+	}
+}
 
-	// overwrite connection's sendHeaderCache
-	leng := len(data)
-	frame.Length = uint32(leng)
+// writeData writes one DATA frame.
+func (con *Connection) writeData(frame *Framer, data []byte, pad int, end bool) error {
 	frame.FType = FrameData
-	// Memo: No Padding
-	frame.Flags = DATA_END_STREAM
-	err := frame.writeFrame(&wBuffer)
-	if err != nil {
-		return err
+	frame.Flags = 0
+	if end {
+		frame.Flags |= DATA_END_STREAM
+	}
+	frame.Length = uint32(len(data))
+	if pad != 0 {
+		frame.Flags |= DATA_PADDED
+		frame.Length += uint32(1 + pad)
 	}
 
-	wBuffer.Write(data)
-	con.W.Write(wBuffer.Bytes())
-
-	return nil
+	wBuffer := make([]byte, 9, 9 + int(frame.Length))
+	frame.putFrameHeader(wBuffer)
+	if pad != 0 {
+		wBuffer = append(wBuffer, uint8(pad))
+	}
+	wBuffer = append(wBuffer, data...)
+	wBuffer = append(wBuffer, make([]byte, pad)...)
+	return con.write(wBuffer)
 }
 
 func ParseData(f *Framer, b []byte) (*Data, error){
-	if f.FType & FrameData != 0 {
+	if f.FType != FrameData {
 		return nil, errors.New("This is not DATA frame.")
 	}
+	if f.StreamID == 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "DATA frame's stream ID must not be 0"}
+	}
 
 	// contains Pad length
 	if (f.Flags & DATA_PADDED) != 0 {
-		pad := int(b[0])
-		// cut padding
-		b = b[1:len(b)-pad]
+		var err error
+		b, err = removePadding(f, b)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	d := &Data{
@@ -194,6 +298,20 @@ func ParseData(f *Framer, b []byte) (*Data, error){
 	return d, nil
 }
 
+// removePadding returns the payload without Pad Length and Padding.
+//  padding as long as the payload or longer is PROTOCOL_ERROR
+func removePadding(f *Framer, b []byte) ([]byte, error) {
+	if len(b) < 1 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, frameName[f.FType] + " frame is too short for Pad Length"}
+	}
+	pad := int(b[0])
+	if pad >= len(b) {
+		return nil, ConnectionError{PROTOCOL_ERROR, frameName[f.FType] + " frame's padding exceeds the payload"}
+	}
+	// cut padding
+	return b[1:len(b)-pad], nil
+}
+
 //----
 
 // HEADER
@@ -210,6 +328,7 @@ func ParseData(f *Framer, b []byte) (*Data, error){
 //    |                           Padding (*)                       ...
 //    +---------------------------------------------------------------+
 type Header struct {
+	Eos        bool   // END_STREAM
 	Dependency uint32 // E + Stream Dependency
 	Weight     uint8
 	Header []hpack.KeyValue
@@ -234,61 +353,214 @@ const (
 // +---------------------------------------------------------------+
 // |                           Padding (*)                       ...
 // +---------------------------------------------------------------+
-func WriteHeader(con *Connection, frame *Framer, header []hpack.KeyValue) error {
-	wBuffer := bytes.Buffer{}
-	encodedHeader, sh, err := hpack.EncodeHeader(header, con.sendHeaderCache)
+// END_STREAM is set unless WithEndStream(false).
+// padding: WithPadding / WithPaddingPolicy, or Connection.Padding
+func WriteHeader(con *Connection, frame *Framer, header []hpack.KeyValue, opts ...WriteOption) error {
+	o := con.writeOptions(opts)
+
+	// the header blocks must be written in the order of encoding
+	// (the peer decodes them with the same dynamic table)
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	// the header block is encoded just after the frame header (9 octets)
+	// and Pad Length in the same buffer, and the frame header is filled afterwards.
+	// Pad Length is fixed after encoding (the policy depends on the block length).
+	wBuffer := make([]byte, 10, 256)
+	wBuffer, sh, err := hpack.AppendEncodeHeader(wBuffer, header, con.sendHeaderCache)
 	if err != nil {
 		return err
 	}
+
+	// 5.1. Stream States
+	//  changed after the block is encoded, nothing is changed on error
+	if err := con.sendHeaders(frame.StreamID, o.endStream); err != nil {
+		return err
+	}
 	// overwrite connection's sendHeaderCache
 	con.sendHeaderCache = sh
-	leng := len(encodedHeader)
-	frame.Length = uint32(leng)
+
 	frame.FType = FrameHeaders
-	// Memo: No Padding, No dependency only
-	frame.Flags = HEADER_END_STREAM|HEADER_END_HEADERS
-	err = frame.writeFrame(&wBuffer)
-	if err != nil {
+	// Memo: No dependency only
+	frame.Flags = 0
+	if o.endStream {
+		frame.Flags |= HEADER_END_STREAM
+	}
+
+	pad := o.paddingFor(len(wBuffer) - 10)
+	if pad == 0 {
+		// no Pad Length
+		wBuffer = wBuffer[1:]
+	} else {
+		frame.Flags |= HEADER_PADDED
+		wBuffer[9] = uint8(pad)
+	}
+	return con.writeHeaderBlock(frame, wBuffer, pad)
+}
+
+// writeHeaderBlock writes the header block b[9:] as frame (HEADERS or PUSH_PROMISE) and
+// CONTINUATION frames, every frame is at most SETTINGS_MAX_FRAME_SIZE of the peer.
+// END_HEADERS is set only on the last frame.
+// con.mu must be held, frames of the other streams can't be written in between.
+//  b[:9]:   space for the first frame header
+//  padding: octets of Padding after the first fragment
+//           (Pad Length is written in b by the caller with PADDED flag)
+//
+//  +---------+----------+---------+  +--------------+----------+  +--------------+----------+
+//  | HEADERS | fragment | Padding |  | CONTINUATION | fragment |  | CONTINUATION | fragment |
+//  |         |          |         |  |              |          |  | END_HEADERS  |          |
+//  +---------+----------+---------+  +--------------+----------+  +--------------+----------+
+func (con *Connection) writeHeaderBlock(frame *Framer, b []byte, padding int) error {
+	max := int(con.maxFrameSize())
+	block := b[9:]
+
+	// fits in one frame: the frame header is written in front of the block
+	if len(block) + padding <= max {
+		frame.Length = uint32(len(block) + padding)
+		frame.Flags |= HEADER_END_HEADERS
+		frame.putFrameHeader(b)
+		b = append(b, make([]byte, padding)...)
+		_, err := con.W.Write(b)
 		return err
 	}
 
-	wBuffer.Write(encodedHeader)
-	con.W.Write(wBuffer.Bytes())
+	first := max - padding
+	wBuffer := make([]byte, 0, len(block) + padding + 9*(len(block)/max + 2))
+	frame.Length = uint32(max)
+	wBuffer = frame.appendFrameHeader(wBuffer)
+	wBuffer = append(wBuffer, block[:first]...)
+	wBuffer = append(wBuffer, make([]byte, padding)...)
+	block = block[first:]
+	for len(block) > 0 {
+		n := len(block)
+		if n > max {
+			n = max
+		}
+		c := &Framer{
+			Length:   uint32(n),
+			FType:    FrameContinuation,
+			StreamID: frame.StreamID,
+		}
+		if n == len(block) {
+			c.Flags = CONTINUATION_END_HEADERS
+		}
+		wBuffer = c.appendFrameHeader(wBuffer)
+		wBuffer = append(wBuffer, block[:n]...)
+		block = block[n:]
+	}
 
-	return nil
+	_, err := con.W.Write(wBuffer)
+	return err
 }
 
+// writeFramePayload writes frame with payload as one Write call.
+// the frame length is checked against SETTINGS_MAX_FRAME_SIZE of the peer.
+func (con *Connection) writeFramePayload(frame *Framer, payload []byte) error {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+
+	if uint32(len(payload)) > con.maxFrameSize() {
+		return fmt.Errorf("%s frame length %d exceeds SETTINGS_MAX_FRAME_SIZE", frameName[frame.FType], len(payload))
+	}
+	frame.Length = uint32(len(payload))
+	wBuffer := make([]byte, 9, 9 + len(payload))
+	frame.putFrameHeader(wBuffer)
+	wBuffer = append(wBuffer, payload...)
+	_, err := con.W.Write(wBuffer)
+	return err
+}
+
+// ParseHeader parses HEADERS frame.
+// when END_HEADERS is not set, the header block fragment is kept in con
+// and nil is returned. the header is returned by ParseContinuation with END_HEADERS.
 func ParseHeader(con *Connection, frame *Framer, b []byte) (*Header, error) {
-	var header *Header
-	if frame.FType & FrameHeaders != 0 {
+	header := &Header{
+		Eos: (frame.Flags & HEADER_END_STREAM) == HEADER_END_STREAM,
+	}
+	if frame.FType != FrameHeaders {
 		return nil, errors.New("This is not HEADERS frame.")
 	}
+	if frame.StreamID == 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "HEADERS frame's stream ID must not be 0"}
+	}
+	if con.continuation != nil {
+		return nil, ConnectionError{PROTOCOL_ERROR, "HEADERS in the middle of a header block"}
+	}
 
 	// contains Pad length
 	if (frame.Flags & HEADER_PADDED) != 0 {
-		pad := int(b[0])
-		// cut padding
-		b = b[1:len(b)-pad]
+		var err error
+		b, err = removePadding(frame, b)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// contains dependency
 	// Memo: not correspond to dependency&weight
 	if (frame.Flags & HEADER_PRIORITY) != 0 {
-		header.Dependency = uint32(b[0] << 24 + b[1] << 16 + b[2] << 8 + b[3])
+		if len(b) < 5 {
+			return nil, ConnectionError{FRAME_SIZE_ERROR, "HEADERS frame is too short for the priority"}
+		}
+		header.Dependency = binary.BigEndian.Uint32(b[0:4])
 		header.Weight = uint8(b[4])
 		b = b[5:]
 	}
 
+	if (frame.Flags & HEADER_END_HEADERS) == 0 {
+		con.continuation = &headerBlock{
+			streamID: frame.StreamID,
+			header:   header,
+			fragment: append([]byte{}, b...),
+		}
+		return nil, nil
+	}
+
 	// decode header
-	h, hc, err := hpack.DecodeHeader(b, con.receiveHeaderCache)
+	h, err := con.decodeHeaderBlock(b)
 	if err != nil {
 		return nil, err
 	}
-	con.receiveHeaderCache = hc
 	header.Header = h
 	return header, nil
 }
 
+// header block in progress
+//  HEADERS (without END_HEADERS) + CONTINUATION ... + CONTINUATION (END_HEADERS)
+//  the fragments are joined and decoded once at END_HEADERS, so that the
+//  receive dynamic table is not changed in the middle of the block.
+type headerBlock struct {
+	streamID uint32
+	header   *Header      // HEADERS which started the block
+	promise  *PushPromise // or PUSH_PROMISE
+	fragment []byte       // header block fragments received so far
+}
+
+// limit of the fragments of a header block kept until END_HEADERS
+// when SETTINGS_MAX_HEADER_LIST_SIZE is not advertised by this endpoint.
+const DEFAULT_MAX_HEADER_BLOCK_SIZE = 1 << 20
+
+// maxHeaderBlockSize returns the limit of a received header block.
+//  SETTINGS_MAX_HEADER_LIST_SIZE of this endpoint is compared with the encoded
+//  block, so that a CONTINUATION flood is stopped before decoding.
+func (con *Connection) maxHeaderBlockSize() int {
+	if max, ok := con.localSettings[MAX_HEADER_LIST_SIZE]; ok {
+		return int(max)
+	}
+	return DEFAULT_MAX_HEADER_BLOCK_SIZE
+}
+
+// decodeHeaderBlock decodes a complete header block with the receive dynamic table.
+// 4.3. a header block which can't be decoded is COMPRESSION_ERROR.
+func (con *Connection) decodeHeaderBlock(b []byte) ([]hpack.KeyValue, error) {
+	h, hc, err := hpack.DecodeHeader(b, con.receiveHeaderCache)
+	if err != nil {
+		return nil, ConnectionError{COMPRESSION_ERROR, err.Error()}
+	}
+	con.receiveHeaderCache = hc
+	return h, nil
+}
+
 
 // PRIORITY
 //
@@ -301,9 +573,36 @@ type Priority struct {
 	Dependency uint32
 	Weight uint8
 }
+func WritePriority(con *Connection, frame *Framer, p Priority) error {
+	if frame.StreamID == 0 {
+		return errors.New("PRIORITY frame's stream ID must not be 0")
+	}
+	// 5.3.1. a stream cannot depend on itself
+	if p.Dependency & (1<<31 - 1) == frame.StreamID {
+		return errors.New("stream cannot depend on itself")
+	}
+	frame.FType = FramePriority
+	frame.Flags = 0
+
+	b := make([]byte, 5)
+	binary.BigEndian.PutUint32(b[0:4], p.Dependency)
+	b[4] = p.Weight
+	return con.writeFramePayload(frame, b)
+}
+
 func ParsePriority(f *Framer, b []byte) (*Priority, error){
+	if f.FType != FramePriority {
+		return nil, errors.New("This is not PRIORITY frame.")
+	}
+	if f.StreamID == 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PRIORITY frame's stream ID must not be 0"}
+	}
+	if len(b) != 5 {
+		return nil, StreamError{f.StreamID, FRAME_SIZE_ERROR, "PRIORITY frame's length must be 5"}
+	}
+
 	p := &Priority{
-		Dependency: uint32(b[0]<<24 + b[1]<<16 + b[2]<<8 + b[3]),
+		Dependency: binary.BigEndian.Uint32(b[0:4]),
 		Weight: b[4],
 	}
 	return p, nil
@@ -317,13 +616,35 @@ type RstStream struct {
 	Error ErrorCode
 }
 
+func WriteRstStream(con *Connection, frame *Framer, code ErrorCode) error {
+	if frame.StreamID == 0 {
+		return errors.New("RstStream's id must not be 0")
+	}
+	frame.FType = FrameRSTStream
+	frame.Flags = 0
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(code))
+	if err := con.writeFramePayload(frame, b); err != nil {
+		return err
+	}
+	con.sendRstStream(frame.StreamID)
+	return nil
+}
+
 func ParseRstStream(f *Framer, b []byte) (*RstStream, error){
+	if f.FType != FrameRSTStream {
+		return nil, errors.New("This is not RST_STREAM frame.")
+	}
 	if f.StreamID == 0 {
-		return nil, errors.New("RstStream's id must not be 0")
+		return nil, ConnectionError{PROTOCOL_ERROR, "RstStream's id must not be 0"}
+	}
+	if len(b) != 4 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "RST_STREAM frame's length must be 4"}
 	}
 
 	rs := &RstStream{
-		Error 		: ErrorCode(b[0]<<24 + b[1]<<16 + b[2]<<8 + b[3]),
+		Error 		: ErrorCode(binary.BigEndian.Uint32(b[0:4])),
 	}
 
 	return rs, nil
@@ -341,11 +662,19 @@ const (
 	SETTINGS_ACK = 0x1
 )
 
+// SETTINGS frame carries zero or more parameters (Params).
+// SETTINGS ACK has no parameter.
 type Settings struct {
+	Params []Setting
+	Ack bool
+}
+
+// one parameter (6 octets)
+type Setting struct {
 	Id    SettingsId
 	Value uint32
-	Ack bool
 }
+
 //
 type SettingsId uint16
 //
@@ -358,46 +687,109 @@ const (
 	MAX_HEADER_LIST_SIZE   SettingsId = 0x6
 )
 
-func (con *Connection) WriteSettings(frame *Framer, d Settings) error {
-	wBuffer := bytes.Buffer{}
-	frame.FType = FrameSettings
-	var leng int
-	if d.Id == 0 {
-		leng = 0
-	} else {
-		leng = 6
+// Value returns the last value of id in the frame.
+func (s *Settings) Value(id SettingsId) (uint32, bool) {
+	v, ok := uint32(0), false
+	for _, p := range s.Params {
+		if p.Id == id {
+			v, ok = p.Value, true
+		}
 	}
-	frame.Length = uint32(leng)
+	return v, ok
+}
 
-	if d.Ack == true {
-		frame.Flags = SETTINGS_ACK
+// 6.5.2. Defined SETTINGS Parameters
+//  ENABLE_PUSH:         0 or 1 (PROTOCOL_ERROR)
+//  INITIAL_WINDOW_SIZE: <= 2^31-1 (FLOW_CONTROL_ERROR)
+//  MAX_FRAME_SIZE:      2^14 to 2^24-1 (PROTOCOL_ERROR)
+func (p Setting) validate() error {
+	switch p.Id {
+	case ENABLE_PUSH:
+		if p.Value > 1 {
+			return ConnectionError{PROTOCOL_ERROR, "SETTINGS_ENABLE_PUSH must be 0 or 1"}
+		}
+	case INITIAL_WINDOW_SIZE:
+		if p.Value > 1<<31 - 1 {
+			return ConnectionError{FLOW_CONTROL_ERROR, "SETTINGS_INITIAL_WINDOW_SIZE exceeds 2^31-1"}
+		}
+	case MAX_FRAME_SIZE:
+		if p.Value < 1<<14 || p.Value > 1<<24 - 1 {
+			return ConnectionError{PROTOCOL_ERROR, "SETTINGS_MAX_FRAME_SIZE is out of range"}
+		}
 	}
+	return nil
+}
 
-	err := frame.writeFrame(&wBuffer)
-	if err != nil {
-		return err
+// 6.5.2 initial value of SETTINGS_MAX_FRAME_SIZE
+const DEFAULT_MAX_FRAME_SIZE = 16384
+
+// maxFrameSize returns SETTINGS_MAX_FRAME_SIZE of the peer.
+// con.mu must be held.
+func (con *Connection) maxFrameSize() uint32 {
+	if v, ok := con.remoteSettings[MAX_FRAME_SIZE]; ok {
+		return v
 	}
+	return DEFAULT_MAX_FRAME_SIZE
+}
 
-	if leng != 0 {
-		binary.Write(&wBuffer, binary.BigEndian, d.Id)
-		binary.Write(&wBuffer, binary.BigEndian, d.Value)
+func (con *Connection) WriteSettings(frame *Framer, d Settings) error {
+	if frame.StreamID != 0 {
+		return errors.New("SETTINGS frame's stream ID must be 0")
+	}
+	frame.FType = FrameSettings
+	frame.Flags = 0
+	if d.Ack == true {
+		if len(d.Params) != 0 {
+			return errors.New("SETTINGS ACK must be empty")
+		}
+		frame.Flags = SETTINGS_ACK
 	}
-	con.W.Write(wBuffer.Bytes())
 
-	return nil
+	b := make([]byte, 0, 6 * len(d.Params))
+	for _, p := range d.Params {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		var param [6]byte
+		binary.BigEndian.PutUint16(param[0:2], uint16(p.Id))
+		binary.BigEndian.PutUint32(param[2:6], p.Value)
+		b = append(b, param[:]...)
+	}
+	return con.writeFramePayload(frame, b)
 }
 
 
 // parse and error handling
+//  unknown identifiers are ignored (not in Params).
 func ParseSettings(f *Framer, b []byte) (*Settings, error) {
+	if f.FType != FrameSettings {
+		return nil, errors.New("This is not SETTINGS frame.")
+	}
+	if f.StreamID != 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "SETTINGS frame's stream ID must be 0"}
+	}
 	s := &Settings{
-		Id:    SettingsId((b[0] << 8) + b[1]),
-		Value: uint32(b[2]<<24 + b[3]<<16 + b[4]<<8 + b[5]),
-		Ack: (f.Flags == SETTINGS_ACK),
+		Ack: (f.Flags & SETTINGS_ACK) == SETTINGS_ACK,
+	}
+	if s.Ack == true && len(b) != 0 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "SETTINGS ACK must be empty"}
+	}
+	if len(b) % 6 != 0 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "SETTINGS frame's length must be a multiple of 6"}
 	}
 
-	if s.Ack == true && s.Value != 0 {
-		return nil, errors.New("value is wrong(ack==true and value not null)")
+	for ; len(b) > 0; b = b[6:] {
+		p := Setting{
+			Id:    SettingsId(binary.BigEndian.Uint16(b[0:2])),
+			Value: binary.BigEndian.Uint32(b[2:6]),
+		}
+		if p.Id < HEADER_TABLE_SIZE || p.Id > MAX_HEADER_LIST_SIZE {
+			continue
+		}
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		s.Params = append(s.Params, p)
 	}
 
 	return s, nil
@@ -414,7 +806,120 @@ func ParseSettings(f *Framer, b []byte) (*Settings, error) {
 //    +---------------------------------------------------------------+
 //    |                           Padding (*)                       ...
 //    +---------------------------------------------------------------+
+type PushPromise struct {
+	PromisedID uint32
+	Padding    uint8 // octets of Padding of the received frame (written by WithPadding)
+	Header     []hpack.KeyValue
+}
+
+const (
+	PUSH_PROMISE_END_HEADERS = 0x4
+	PUSH_PROMISE_PADDED      = 0x8
+)
+
+// padding: WithPadding / WithPaddingPolicy, or Connection.Padding
+// (WithEndStream is ignored, PUSH_PROMISE has no END_STREAM)
+func WritePushPromise(con *Connection, frame *Framer, pp PushPromise, opts ...WriteOption) error {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	return con.writePushPromise(frame, pp, opts...)
+}
 
+// writePushPromise writes PUSH_PROMISE (+ CONTINUATION), con.mu must be held.
+func (con *Connection) writePushPromise(frame *Framer, pp PushPromise, opts ...WriteOption) error {
+	if frame.StreamID == 0 {
+		return errors.New("PUSH_PROMISE frame's stream ID must not be 0")
+	}
+	if pp.PromisedID == 0 || pp.PromisedID > 1<<31 - 1 {
+		return errors.New("invalid promised stream ID")
+	}
+	// frame header (9) + Pad Length? (1) + Promised Stream ID (4) + header block
+	b := make([]byte, 14, 256)
+	binary.BigEndian.PutUint32(b[10:14], pp.PromisedID)
+	wBuffer, sh, err := hpack.AppendEncodeHeader(b, pp.Header, con.sendHeaderCache)
+	if err != nil {
+		return err
+	}
+	// the promised stream is reserved after the block is encoded
+	if err := con.sendPushPromise(frame.StreamID, pp.PromisedID); err != nil {
+		return err
+	}
+	con.sendHeaderCache = sh
+	frame.FType = FramePushPromise
+	frame.Flags = 0
+
+	pad := con.writeOptions(opts).paddingFor(len(wBuffer) - 14)
+	if pad == 0 {
+		// no Pad Length
+		wBuffer = wBuffer[1:]
+	} else {
+		frame.Flags |= PUSH_PROMISE_PADDED
+		wBuffer[9] = uint8(pad)
+	}
+
+	// the first frame carries the Promised Stream ID and the beginning of the block
+	return con.writeHeaderBlock(frame, wBuffer, pad)
+}
+
+// ParsePushPromise parses PUSH_PROMISE frame.
+// like ParseHeader, nil is returned until END_HEADERS (see ParseContinuation).
+//
+// 8.4. Server Push
+//  PUSH_PROMISE received by a server, or after SETTINGS_ENABLE_PUSH = 0 was
+//  acknowledged, is a connection error (PROTOCOL_ERROR).
+func ParsePushPromise(con *Connection, frame *Framer, b []byte) (*PushPromise, error) {
+	if frame.FType != FramePushPromise {
+		return nil, errors.New("This is not PUSH_PROMISE frame.")
+	}
+	if frame.StreamID == 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PUSH_PROMISE frame's stream ID must not be 0"}
+	}
+	if con.role == RoleServer {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PUSH_PROMISE sent by the client"}
+	}
+	if con.localSettings[ENABLE_PUSH] == 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PUSH_PROMISE while SETTINGS_ENABLE_PUSH is 0"}
+	}
+	if con.continuation != nil {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PUSH_PROMISE in the middle of a header block"}
+	}
+
+	pp := &PushPromise{}
+	if (frame.Flags & PUSH_PROMISE_PADDED) != 0 {
+		var err error
+		if len(b) > 0 {
+			pp.Padding = b[0]
+		}
+		b, err = removePadding(frame, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b) < 4 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "PUSH_PROMISE frame is too short for the promised stream ID"}
+	}
+	pp.PromisedID = binary.BigEndian.Uint32(b[0:4]) & (1<<31 - 1) // R is ignored
+	if pp.PromisedID == 0 || pp.PromisedID % 2 != 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "invalid promised stream ID"}
+	}
+	b = b[4:]
+
+	if (frame.Flags & PUSH_PROMISE_END_HEADERS) == 0 {
+		con.continuation = &headerBlock{
+			streamID: frame.StreamID,
+			promise:  pp,
+			fragment: append([]byte{}, b...),
+		}
+		return nil, nil
+	}
+
+	h, err := con.decodeHeaderBlock(b)
+	if err != nil {
+		return nil, err
+	}
+	pp.Header = h
+	return pp, nil
+}
 
 
 // PING
@@ -423,13 +928,46 @@ func ParseSettings(f *Framer, b []byte) (*Settings, error) {
 //    |                      Opaque Data (64)                         |
 //    |                                                               |
 //    +---------------------------------------------------------------+
+const (
+	PING_ACK = 0x1
+)
+
+// PING carries 8 octets of opaque data, ACK echoes the data of the PING.
+type Ping struct {
+	Ack  bool
+	Data [8]byte
+}
+
+func WritePing(con *Connection, frame *Framer, p Ping) error {
+	if frame.StreamID != 0 {
+		return errors.New("PING frame's stream ID must be 0")
+	}
+	frame.FType = FramePing
+	frame.Flags = 0
+	if p.Ack {
+		frame.Flags = PING_ACK
+	}
+	return con.writeFramePayload(frame, p.Data[:])
+}
+
 // parse and error handling
-func ParsePing(f *Framer, b []byte) (*WindowUpdate, error) {
-	wu := &WindowUpdate{
-		WindowSizeIncrement:    uint32((b[0] << 24) + (b[1] << 16) + (b[2] << 8) + b[3]),
+func ParsePing(f *Framer, b []byte) (*Ping, error) {
+	if f.FType != FramePing {
+		return nil, errors.New("This is not PING frame.")
+	}
+	if f.StreamID != 0 {
+		return nil, ConnectionError{PROTOCOL_ERROR, "PING frame's stream ID must be 0"}
+	}
+	if len(b) != 8 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "PING frame's length must be 8"}
 	}
 
-	return wu, nil
+	p := &Ping{
+		Ack: (f.Flags & PING_ACK) == PING_ACK,
+	}
+	copy(p.Data[:], b)
+
+	return p, nil
 }
 
 
@@ -447,15 +985,38 @@ type GoAway struct {
 	AdditionalDebugData []byte
 }
 
+func WriteGoAway(con *Connection, frame *Framer, ga GoAway) error {
+	if frame.StreamID != 0 {
+		return errors.New("GoAway frame's stream ID must be 0")
+	}
+	if ga.LastStreamId > 1<<31 - 1 {
+		return errors.New("invalid last stream ID")
+	}
+	frame.FType = FrameGoAway
+	frame.Flags = 0
+
+	b := make([]byte, 8, 8 + len(ga.AdditionalDebugData))
+	binary.BigEndian.PutUint32(b[0:4], ga.LastStreamId)
+	binary.BigEndian.PutUint32(b[4:8], uint32(ga.Error))
+	b = append(b, ga.AdditionalDebugData...)
+	return con.writeFramePayload(frame, b)
+}
+
 // parse and error handling
 func ParseGoAway(f *Framer, b []byte) (*GoAway, error) {
+	if f.FType != FrameGoAway {
+		return nil, errors.New("This is not GOAWAY frame.")
+	}
 	if f.StreamID != 0 {
-		return nil, errors.New("GoAway frame's stream ID must be 0")
+		return nil, ConnectionError{PROTOCOL_ERROR, "GoAway frame's stream ID must be 0"}
+	}
+	if len(b) < 8 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "GOAWAY frame is too short"}
 	}
 
 	ga := &GoAway{
-		LastStreamId:    uint32((b[0] << 24) + (b[1] << 16) + (b[2] << 8) + b[3]),
-		Error: ErrorCode(b[4]<<24 + b[5]<<16 + b[6]<<8 + b[7]),
+		LastStreamId:    binary.BigEndian.Uint32(b[0:4]) & (1<<31 - 1), // R is ignored
+		Error: ErrorCode(binary.BigEndian.Uint32(b[4:8])),
 	}
 
 	if len(b) > 8 {
@@ -475,10 +1036,37 @@ type WindowUpdate struct {
 	WindowSizeIncrement uint32 // R+Window Size Increment (31)
 }
 
+// 6.9. increment: 1 to 2^31-1
+func WriteWindowUpdate(con *Connection, frame *Framer, increment uint32) error {
+	if increment == 0 || increment > 1<<31 - 1 {
+		return errors.New("invalid window size increment")
+	}
+	frame.FType = FrameWindowUpdate
+	frame.Flags = 0
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, increment)
+	return con.writeFramePayload(frame, b)
+}
+
 // parse and error handling
 func ParseWindowUpdate(f *Framer, b []byte) (*WindowUpdate, error) {
+	if f.FType != FrameWindowUpdate {
+		return nil, errors.New("This is not WINDOW_UPDATE frame.")
+	}
+	if len(b) != 4 {
+		return nil, ConnectionError{FRAME_SIZE_ERROR, "WINDOW_UPDATE frame's length must be 4"}
+	}
 	wu := &WindowUpdate{
-		WindowSizeIncrement:    uint32((b[0] << 24) + (b[1] << 16) + (b[2] << 8) + b[3]),
+		WindowSizeIncrement:    binary.BigEndian.Uint32(b[0:4]) & (1<<31 - 1), // R is ignored
+	}
+
+	// 6.9. increment of 0 is PROTOCOL_ERROR
+	if wu.WindowSizeIncrement == 0 {
+		if f.StreamID == 0 {
+			return nil, ConnectionError{PROTOCOL_ERROR, "WINDOW_UPDATE with increment 0"}
+		}
+		return nil, StreamError{f.StreamID, PROTOCOL_ERROR, "WINDOW_UPDATE with increment 0"}
 	}
 
 	return wu, nil
@@ -489,25 +1077,104 @@ func ParseWindowUpdate(f *Framer, b []byte) (*WindowUpdate, error) {
 //    +---------------------------------------------------------------+
 //    |                   Header Block Fragment (*)                 ...
 //    +---------------------------------------------------------------+
-type Continuation struct {
-	Header []hpack.KeyValue
-}
+const (
+	CONTINUATION_END_HEADERS = 0x4
+)
 
-// parse and error handling
-func ParseContinuation(con *Connection, b []byte) (*Continuation, error) {
-	kv, hc, err := hpack.DecodeHeader(b, con.receiveHeaderCache)
-	if err != nil {
-		return nil, err
+// WriteContinuation writes one fragment of a header block.
+// WriteHeader and WritePushPromise already split large blocks, this is for
+// callers which encode the header block by themselves.
+func WriteContinuation(con *Connection, frame *Framer, fragment []byte, endHeaders bool) error {
+	if frame.StreamID == 0 {
+		return errors.New("CONTINUATION frame's stream ID must not be 0")
 	}
-
-	con.receiveHeaderCache = hc
-
-	return &Continuation{Header: kv}, nil
+	frame.FType = FrameContinuation
+	frame.Flags = 0
+	if endHeaders {
+		frame.Flags = CONTINUATION_END_HEADERS
+	}
+	return con.writeFramePayload(frame, fragment)
 }
 
+// ParseContinuation appends the header block fragment to the block in progress.
+// the frame which started the block (*Header or *PushPromise) is returned
+// with END_HEADERS, otherwise nil.
+// a block larger than maxHeaderBlockSize is a connection error (ENHANCE_YOUR_CALM).
+func ParseContinuation(con *Connection, f *Framer, b []byte) (interface{}, error) {
+	if f.FType != FrameContinuation {
+		return nil, errors.New("This is not CONTINUATION frame.")
+	}
+	hb := con.continuation
+	if hb == nil {
+		return nil, ConnectionError{PROTOCOL_ERROR, "CONTINUATION without HEADERS"}
+	}
+	if f.StreamID != hb.streamID {
+		return nil, ConnectionError{PROTOCOL_ERROR, "CONTINUATION on another stream"}
+	}
 
+	if len(hb.fragment)+len(b) > con.maxHeaderBlockSize() {
+		con.continuation = nil
+		return nil, ConnectionError{ENHANCE_YOUR_CALM, "header block exceeds the limit"}
+	}
+	hb.fragment = append(hb.fragment, b...)
+	if (f.Flags & CONTINUATION_END_HEADERS) == 0 {
+		return nil, nil
+	}
 
+	con.continuation = nil
+	h, err := con.decodeHeaderBlock(hb.fragment)
+	if err != nil {
+		return nil, err
+	}
+	if hb.promise != nil {
+		hb.promise.Header = h
+		return hb.promise, nil
+	}
+	hb.header.Header = h
+	return hb.header, nil
+}
 
+// ParseFrame parses the frame payload b and returns the frame
+// (*Data, *Header, *PushPromise, *Priority, *RstStream, *Settings, *Ping, *GoAway, *WindowUpdate ...).
+// nil is returned for the fragments of a header block until END_HEADERS,
+// and for frames of unknown type (which must be ignored).
+//
+// 6.10. while a header block is in progress, any frame other than
+// CONTINUATION on the same stream is a connection error (PROTOCOL_ERROR).
+func (con *Connection) ParseFrame(f *Framer, b []byte) (interface{}, error) {
+	if hb := con.continuation; hb != nil && (f.FType != FrameContinuation || f.StreamID != hb.streamID) {
+		return nil, ConnectionError{PROTOCOL_ERROR, frameName[f.FType] + " frame in the middle of a header block"}
+	}
 
-
-
+	switch f.FType {
+	case FrameData:
+		return ParseData(f, b)
+	case FrameHeaders:
+		h, err := ParseHeader(con, f, b)
+		if h == nil {
+			return nil, err
+		}
+		return h, nil
+	case FramePushPromise:
+		pp, err := ParsePushPromise(con, f, b)
+		if pp == nil {
+			return nil, err
+		}
+		return pp, nil
+	case FramePriority:
+		return ParsePriority(f, b)
+	case FrameRSTStream:
+		return ParseRstStream(f, b)
+	case FrameSettings:
+		return ParseSettings(f, b)
+	case FramePing:
+		return ParsePing(f, b)
+	case FrameGoAway:
+		return ParseGoAway(f, b)
+	case FrameWindowUpdate:
+		return ParseWindowUpdate(f, b)
+	case FrameContinuation:
+		return ParseContinuation(con, f, b)
+	}
+	return nil, nil
+}
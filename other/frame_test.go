@@ -2,7 +2,11 @@ package minihttp2
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
 	"testing"
+	"./hpack"
 )
 
 func TestPreface(t *testing.T) {
@@ -29,13 +33,13 @@ func TestParseGoAway(t *testing.T) {
 	testOriginal := []byte{0x00,0x00,0x00,0x01,0x00,0x00,0x00,0x01}
 	v, _:= ParseGoAway(f, testOriginal)
 	if v.LastStreamId != 0x01 {
-		t.Fatalf("Error: ParseGoAway Error", v.LastStreamId)
+		t.Fatalf("Error: ParseGoAway Error %v", v.LastStreamId)
 	}
 	if v.Error != PROTOCOL_ERROR {
-		t.Fatalf("Error: ParseGoAway Error", v.Error)
+		t.Fatalf("Error: ParseGoAway Error %v", v.Error)
 	}
 	if len(v.AdditionalDebugData) != 0 {
-		t.Fatalf("Error: ParseGoAway Error", v.AdditionalDebugData)
+		t.Fatalf("Error: ParseGoAway Error %v", v.AdditionalDebugData)
 	}
 
 	// Contains Additonal Debug Data
@@ -53,10 +57,10 @@ func TestParseGoAway(t *testing.T) {
 	testOriginal = append(testOriginal, []byte("GoAway")...)
 	v, _= ParseGoAway(f, testOriginal)
 	if v.Error != PROTOCOL_ERROR {
-		t.Fatalf("Error: ParseGoAway Error", v.Error)
+		t.Fatalf("Error: ParseGoAway Error %v", v.Error)
 	}
 	if string(v.AdditionalDebugData) != "GoAway" {
-		t.Fatalf("Error: ParseGoAway AdditionalDebugData", v.AdditionalDebugData)
+		t.Fatalf("Error: ParseGoAway AdditionalDebugData %v", v.AdditionalDebugData)
 	}
 
 	// Error Case
@@ -71,18 +75,19 @@ func TestParseGoAway(t *testing.T) {
 	testOriginal = append(testOriginal, []byte("GoAway")...)
 	_, err:= ParseGoAway(f, testOriginal)
 	if err == nil {
-		t.Fatalf("Error: ParseGoAway doesn't send error", err)
+		t.Fatalf("Error: ParseGoAway doesn't send error %v", err)
 	}
 
 }
 
 func TestParseData(t *testing.T) {
 	// Without Padding
+	// StreamId Of DATA Frame must not be 0.
 	f := &Framer{
 		8,
 		FrameData,
 		0,
-		0x0,
+		0x1,
 	}
 	testOriginal := []byte("Data Test")
 	v, _ := ParseData(f, testOriginal)
@@ -101,4 +106,709 @@ func TestParseData(t *testing.T) {
 		t.Fatalf("Error: ParseData doen't correct parse %v", v.Content)
 	}
 
-}
\ No newline at end of file
+}
+
+// splitFrames splits b into frame headers and payloads
+func splitFrames(t *testing.T, b []byte) ([]Framer, [][]byte) {
+	frames := []Framer{}
+	payloads := [][]byte{}
+	for len(b) > 0 {
+		if len(b) < 9 {
+			t.Fatalf("Error: frame header is not complete %x", b)
+		}
+		f := Framer{
+			Length:   binary.BigEndian.Uint32(b[0:4]) >> 8,
+			FType:    FrameType(b[3]),
+			Flags:    b[4],
+			StreamID: binary.BigEndian.Uint32(b[5:9]) & (1<<31 - 1),
+		}
+		frames = append(frames, f)
+		payloads = append(payloads, b[9:9+f.Length])
+		b = b[9+f.Length:]
+	}
+	return frames, payloads
+}
+
+func TestWriteHeaderSplit(t *testing.T) {
+	header := []hpack.KeyValue{
+		{Key: ":status", Value: "200"},
+		{Key: "x-large", Value: strings.Repeat("a", 40000)},
+	}
+	for _, max := range []uint32{0, 16385, 20000} {
+		w := &bytes.Buffer{}
+		con := NewClientConn(w)
+		con.sendHeaderCache.DisableHuffman = true
+		delete(con.remoteSettings, MAX_FRAME_SIZE)
+		if max != 0 {
+			con.remoteSettings[MAX_FRAME_SIZE] = max
+		} else {
+			max = DEFAULT_MAX_FRAME_SIZE
+		}
+		if err := WriteHeader(con, &Framer{StreamID: 3}, header); err != nil {
+			t.Fatalf("Error: WriteHeader %v", err)
+		}
+
+		frames, payloads := splitFrames(t, w.Bytes())
+		if len(frames) < 3 {
+			t.Fatalf("Error: WriteHeader max=%d doesn't split the block (%d frames)", max, len(frames))
+		}
+		block := []byte{}
+		for i, f := range frames {
+			want := FrameContinuation
+			if i == 0 {
+				want = FrameHeaders
+			}
+			if f.FType != want || f.StreamID != 3 || f.Length > max {
+				t.Fatalf("Error: WriteHeader frame %d: %+v", i, f)
+			}
+			if last := i == len(frames)-1; (f.Flags&HEADER_END_HEADERS != 0) != last {
+				t.Fatalf("Error: WriteHeader frame %d: END_HEADERS flags=%x", i, f.Flags)
+			}
+			block = append(block, payloads[i]...)
+		}
+		if frames[0].Flags&HEADER_END_STREAM == 0 || frames[1].Flags&HEADER_END_STREAM != 0 {
+			t.Fatalf("Error: WriteHeader END_STREAM flags=%x %x", frames[0].Flags, frames[1].Flags)
+		}
+
+		kv, _, err := hpack.DecodeHeader(block, hpack.HpackConn{TableSizeLimit: 4096})
+		if err != nil || len(kv) != 2 || kv[1].Value != header[1].Value {
+			t.Fatalf("Error: WriteHeader header block is broken %v", err)
+		}
+	}
+
+	// small header block is sent as one frame
+	w := &bytes.Buffer{}
+	con := NewClientConn(w)
+	WriteHeader(con, &Framer{StreamID: 1}, header[:1])
+	frames, _ := splitFrames(t, w.Bytes())
+	if len(frames) != 1 || frames[0].Flags != HEADER_END_STREAM|HEADER_END_HEADERS {
+		t.Fatalf("Error: WriteHeader small block %+v", frames)
+	}
+}
+
+func TestParseFrameContinuation(t *testing.T) {
+	header := []hpack.KeyValue{
+		{Key: ":status", Value: "200"},
+		{Key: "x-large", Value: strings.Repeat("abcdefghij", 4000)},
+		{Key: "x-next", Value: "next"},
+	}
+	w := &bytes.Buffer{}
+	sender := NewClientConn(w)
+	WriteHeader(sender, &Framer{StreamID: 5}, header)
+	frames, payloads := splitFrames(t, w.Bytes())
+
+	receiver := &Connection{receiveHeaderCache: hpack.HpackConn{TableSizeLimit: 4096}}
+	for i := range frames {
+		v, err := receiver.ParseFrame(&frames[i], payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseFrame frame %d %v", i, err)
+		}
+		if i < len(frames)-1 {
+			if v != nil {
+				t.Fatalf("Error: ParseFrame frame %d returns %v before END_HEADERS", i, v)
+			}
+			// the receive table is not changed in the middle of the block
+			if receiver.receiveHeaderCache.Len() != 0 {
+				t.Fatalf("Error: ParseFrame frame %d changes the dynamic table", i)
+			}
+			continue
+		}
+		h, ok := v.(*Header)
+		if !ok || len(h.Header) != 3 || h.Header[1].Value != header[1].Value || h.Header[2].Value != "next" {
+			t.Fatalf("Error: ParseFrame header block is broken %v", v)
+		}
+	}
+	if receiver.continuation != nil {
+		t.Fatalf("Error: ParseFrame header block is not finished")
+	}
+
+	// interleaved frames are PROTOCOL_ERROR
+	for _, f := range []Framer{
+		{Length: 0, FType: FrameData, StreamID: 5},
+		{Length: 0, FType: FrameContinuation, StreamID: 7},
+		{Length: 0, FType: FrameHeaders, Flags: HEADER_END_HEADERS, StreamID: 7},
+	} {
+		receiver := &Connection{receiveHeaderCache: hpack.HpackConn{TableSizeLimit: 4096}}
+		receiver.ParseFrame(&frames[0], payloads[0])
+		if _, err := receiver.ParseFrame(&f, []byte{}); err == nil {
+			t.Fatalf("Error: ParseFrame %s doesn't send error", frameName[f.FType])
+		}
+	}
+
+	// CONTINUATION without HEADERS
+	if _, err := receiver.ParseFrame(&frames[1], payloads[1]); err == nil {
+		t.Fatalf("Error: ParseFrame CONTINUATION without HEADERS doesn't send error")
+	}
+}
+
+func TestParseHeaderBlockError(t *testing.T) {
+	// malformed header blocks are COMPRESSION_ERROR
+	for _, block := range [][]byte{{0x3f}, {0x40, 0x05, 0x61}, {0x82, 0xff}, {0xff, 0x83, 0xff, 0x03}} {
+		receiver := NewServerConn(&bytes.Buffer{})
+		f := &Framer{Length: uint32(len(block)), FType: FrameHeaders, Flags: HEADER_END_HEADERS, StreamID: 1}
+		_, err := receiver.ParseFrame(f, block)
+		if e, ok := err.(ConnectionError); !ok || e.Code != COMPRESSION_ERROR {
+			t.Fatalf("Error: ParseFrame %x want=COMPRESSION_ERROR, ans=%v", block, err)
+		}
+	}
+
+	// CONTINUATION flood is stopped by SETTINGS_MAX_HEADER_LIST_SIZE
+	receiver := NewServerConn(&bytes.Buffer{})
+	receiver.localSettings[MAX_HEADER_LIST_SIZE] = 100
+	fragment := bytes.Repeat([]byte{0x82}, 40)
+	if _, err := receiver.ParseFrame(&Framer{Length: 40, FType: FrameHeaders, StreamID: 1}, fragment); err != nil {
+		t.Fatalf("Error: ParseFrame HEADERS %v", err)
+	}
+	if _, err := receiver.ParseFrame(&Framer{Length: 40, FType: FrameContinuation, StreamID: 1}, fragment); err != nil {
+		t.Fatalf("Error: ParseFrame CONTINUATION %v", err)
+	}
+	_, err := receiver.ParseFrame(&Framer{Length: 40, FType: FrameContinuation, StreamID: 1}, fragment)
+	if e, ok := err.(ConnectionError); !ok || e.Code != ENHANCE_YOUR_CALM {
+		t.Fatalf("Error: ParseFrame CONTINUATION want=ENHANCE_YOUR_CALM, ans=%v", err)
+	}
+}
+
+func TestReadFrameLarge(t *testing.T) {
+	// Length = 0x012c03 (76803), R = 1, Stream ID = 0x7fff0102
+	b := []byte{0x01, 0x2c, 0x03, byte(FrameData), 0x1, 0xff, 0xff, 0x01, 0x02}
+	b = append(b, bytes.Repeat([]byte{0xaa}, 0x012c03)...)
+	b = append(b, 0xbb)
+	f, payload, remain, err := ReadFrame(b)
+	if err != nil {
+		t.Fatalf("Error: ReadFrame %v", err)
+	}
+	if f.Length != 0x012c03 || f.StreamID != 0x7fff0102 || f.FType != FrameData || f.Flags != 0x1 {
+		t.Fatalf("Error: ReadFrame %+v", f)
+	}
+	if len(payload) != 0x012c03 || len(remain) != 1 || remain[0] != 0xbb {
+		t.Fatalf("Error: ReadFrame payload=%d remain=%x", len(payload), remain)
+	}
+
+	// written frame header is read again
+	w := &bytes.Buffer{}
+	f = &Framer{Length: 300, FType: FrameHeaders, Flags: 0x4, StreamID: 0x12345}
+	f.writeFrame(w)
+	w.Write(make([]byte, 300))
+	ans, _, _, err := ReadFrame(w.Bytes())
+	if err != nil || *ans != *f {
+		t.Fatalf("Error: ReadFrame want=%+v, ans=%+v %v", f, ans, err)
+	}
+}
+
+func TestParseLargeValues(t *testing.T) {
+	// Last Stream Id = 0x7fff0102 (R = 1), Error Code = 0x0102030d
+	ga, err := ParseGoAway(&Framer{Length: 8, FType: FrameGoAway}, []byte{0xff, 0xff, 0x01, 0x02, 0x01, 0x02, 0x03, 0x0d})
+	if err != nil || ga.LastStreamId != 0x7fff0102 || ga.Error != 0x0102030d {
+		t.Fatalf("Error: ParseGoAway %+v %v", ga, err)
+	}
+
+	s, err := ParseSettings(&Framer{Length: 6, FType: FrameSettings}, []byte{0x00, 0x05, 0x00, 0xff, 0xff, 0xff})
+	if err != nil || len(s.Params) != 1 || s.Params[0].Id != MAX_FRAME_SIZE || s.Params[0].Value != 0xffffff {
+		t.Fatalf("Error: ParseSettings %+v %v", s, err)
+	}
+	s, err = ParseSettings(&Framer{Length: 6, FType: FrameSettings}, []byte{0x00, 0x06, 0x80, 0x00, 0x00, 0x01})
+	if err != nil || len(s.Params) != 1 || s.Params[0].Id != MAX_HEADER_LIST_SIZE || s.Params[0].Value != 0x80000001 {
+		t.Fatalf("Error: ParseSettings %+v %v", s, err)
+	}
+
+	rs, err := ParseRstStream(&Framer{Length: 4, FType: FrameRSTStream, StreamID: 0x10001}, []byte{0x00, 0x00, 0x01, 0x08})
+	if err != nil || rs.Error != 0x108 {
+		t.Fatalf("Error: ParseRstStream %+v %v", rs, err)
+	}
+
+	// E = 1, Stream Dependency = 0x00010203
+	p, err := ParsePriority(&Framer{Length: 5, FType: FramePriority, StreamID: 3}, []byte{0x80, 0x01, 0x02, 0x03, 0xff})
+	if err != nil || p.Dependency != 0x80010203 || p.Weight != 0xff {
+		t.Fatalf("Error: ParsePriority %+v %v", p, err)
+	}
+
+	// R = 1, Window Size Increment = 0x7fffffff
+	wu, err := ParseWindowUpdate(&Framer{Length: 4, FType: FrameWindowUpdate}, []byte{0xff, 0xff, 0xff, 0xff})
+	if err != nil || wu.WindowSizeIncrement != 0x7fffffff {
+		t.Fatalf("Error: ParseWindowUpdate %+v %v", wu, err)
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	type errorCase struct {
+		name   string
+		parse  func(f *Framer, b []byte) (interface{}, error)
+		frame  Framer
+		b      []byte
+		stream bool // StreamError (otherwise ConnectionError)
+		code   ErrorCode
+	}
+	data := func(f *Framer, b []byte) (interface{}, error) { return ParseData(f, b) }
+	priority := func(f *Framer, b []byte) (interface{}, error) { return ParsePriority(f, b) }
+	rst := func(f *Framer, b []byte) (interface{}, error) { return ParseRstStream(f, b) }
+	settings := func(f *Framer, b []byte) (interface{}, error) { return ParseSettings(f, b) }
+	ping := func(f *Framer, b []byte) (interface{}, error) { return ParsePing(f, b) }
+	goaway := func(f *Framer, b []byte) (interface{}, error) { return ParseGoAway(f, b) }
+	window := func(f *Framer, b []byte) (interface{}, error) { return ParseWindowUpdate(f, b) }
+	headers := func(f *Framer, b []byte) (interface{}, error) {
+		return ParseHeader(&Connection{receiveHeaderCache: hpack.HpackConn{TableSizeLimit: 4096}}, f, b)
+	}
+	promise := func(f *Framer, b []byte) (interface{}, error) {
+		return ParsePushPromise(NewClientConn(&bytes.Buffer{}), f, b)
+	}
+	promiseServer := func(f *Framer, b []byte) (interface{}, error) {
+		return ParsePushPromise(NewServerConn(&bytes.Buffer{}), f, b)
+	}
+	promiseDisabled := func(f *Framer, b []byte) (interface{}, error) {
+		client := NewClientConn(&bytes.Buffer{})
+		client.localSettings[ENABLE_PUSH] = 0
+		return ParsePushPromise(client, f, b)
+	}
+
+	for _, c := range []errorCase{
+		{"DATA stream 0", data, Framer{FType: FrameData}, []byte("a"), false, PROTOCOL_ERROR},
+		{"DATA padding", data, Framer{FType: FrameData, Flags: DATA_PADDED, StreamID: 1}, []byte{0x2, 0x0}, false, PROTOCOL_ERROR},
+		{"DATA no Pad Length", data, Framer{FType: FrameData, Flags: DATA_PADDED, StreamID: 1}, []byte{}, false, FRAME_SIZE_ERROR},
+		{"HEADERS stream 0", headers, Framer{FType: FrameHeaders, Flags: HEADER_END_HEADERS}, []byte{0x82}, false, PROTOCOL_ERROR},
+		{"HEADERS priority", headers, Framer{FType: FrameHeaders, Flags: HEADER_END_HEADERS | HEADER_PRIORITY, StreamID: 1}, []byte{0x0, 0x0}, false, FRAME_SIZE_ERROR},
+		{"HEADERS compression", headers, Framer{FType: FrameHeaders, Flags: HEADER_END_HEADERS, StreamID: 1}, []byte{0xff, 0x80, 0x01}, false, COMPRESSION_ERROR},
+		{"PUSH_PROMISE stream 0", promise, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS}, []byte{0, 0, 0, 2, 0x82}, false, PROTOCOL_ERROR},
+		{"PUSH_PROMISE padding", promise, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS | PUSH_PROMISE_PADDED, StreamID: 1}, []byte{5, 0, 0, 0, 2}, false, PROTOCOL_ERROR},
+		{"PUSH_PROMISE length", promise, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS, StreamID: 1}, []byte{0, 0, 2}, false, FRAME_SIZE_ERROR},
+		{"PUSH_PROMISE odd promised ID", promise, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS, StreamID: 1}, []byte{0, 0, 0, 3, 0x82}, false, PROTOCOL_ERROR},
+		{"PUSH_PROMISE to server", promiseServer, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS, StreamID: 1}, []byte{0, 0, 0, 2, 0x82}, false, PROTOCOL_ERROR},
+		{"PUSH_PROMISE push disabled", promiseDisabled, Framer{FType: FramePushPromise, Flags: PUSH_PROMISE_END_HEADERS, StreamID: 1}, []byte{0, 0, 0, 2, 0x82}, false, PROTOCOL_ERROR},
+		{"PRIORITY stream 0", priority, Framer{FType: FramePriority}, make([]byte, 5), false, PROTOCOL_ERROR},
+		{"PRIORITY length", priority, Framer{FType: FramePriority, StreamID: 3}, make([]byte, 4), true, FRAME_SIZE_ERROR},
+		{"RST_STREAM stream 0", rst, Framer{FType: FrameRSTStream}, make([]byte, 4), false, PROTOCOL_ERROR},
+		{"RST_STREAM length", rst, Framer{FType: FrameRSTStream, StreamID: 1}, make([]byte, 5), false, FRAME_SIZE_ERROR},
+		{"SETTINGS stream 1", settings, Framer{FType: FrameSettings, StreamID: 1}, []byte{}, false, PROTOCOL_ERROR},
+		{"SETTINGS ACK length", settings, Framer{FType: FrameSettings, Flags: SETTINGS_ACK}, make([]byte, 6), false, FRAME_SIZE_ERROR},
+		{"SETTINGS length", settings, Framer{FType: FrameSettings}, make([]byte, 5), false, FRAME_SIZE_ERROR},
+		{"PING stream 1", ping, Framer{FType: FramePing, StreamID: 1}, make([]byte, 8), false, PROTOCOL_ERROR},
+		{"PING length", ping, Framer{FType: FramePing}, make([]byte, 7), false, FRAME_SIZE_ERROR},
+		{"GOAWAY length", goaway, Framer{FType: FrameGoAway}, make([]byte, 7), false, FRAME_SIZE_ERROR},
+		{"WINDOW_UPDATE length", window, Framer{FType: FrameWindowUpdate}, make([]byte, 3), false, FRAME_SIZE_ERROR},
+		{"WINDOW_UPDATE 0 connection", window, Framer{FType: FrameWindowUpdate}, make([]byte, 4), false, PROTOCOL_ERROR},
+		{"WINDOW_UPDATE 0 stream", window, Framer{FType: FrameWindowUpdate, StreamID: 1}, make([]byte, 4), true, PROTOCOL_ERROR},
+	} {
+		c.frame.Length = uint32(len(c.b))
+		_, err := c.parse(&c.frame, c.b)
+		switch e := err.(type) {
+		case ConnectionError:
+			if c.stream || e.Code != c.code {
+				t.Fatalf("Error: %s want=%s (stream=%v), ans=%v", c.name, c.code, c.stream, err)
+			}
+		case StreamError:
+			if !c.stream || e.Code != c.code || e.StreamID != c.frame.StreamID {
+				t.Fatalf("Error: %s want=%s (stream=%v), ans=%v", c.name, c.code, c.stream, err)
+			}
+		default:
+			t.Fatalf("Error: %s want=%s, ans=%v", c.name, c.code, err)
+		}
+	}
+
+	// wrong frame type
+	if _, err := ParseData(&Framer{FType: FrameHeaders, StreamID: 1}, []byte("a")); err == nil {
+		t.Fatalf("Error: ParseData accepts HEADERS frame")
+	}
+	if _, err := ParseSettings(&Framer{FType: FramePing}, make([]byte, 6)); err == nil {
+		t.Fatalf("Error: ParseSettings accepts PING frame")
+	}
+
+	// SETTINGS without parameters / SETTINGS ACK
+	if s, err := ParseSettings(&Framer{FType: FrameSettings}, []byte{}); err != nil || s.Ack {
+		t.Fatalf("Error: ParseSettings empty %+v %v", s, err)
+	}
+	if s, err := ParseSettings(&Framer{FType: FrameSettings, Flags: SETTINGS_ACK}, []byte{}); err != nil || !s.Ack {
+		t.Fatalf("Error: ParseSettings ACK %+v %v", s, err)
+	}
+}
+
+func TestWriteFrames(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+
+	if err := WritePriority(client, &Framer{StreamID: 3}, Priority{Dependency: 0x80000001, Weight: 15}); err != nil {
+		t.Fatalf("Error: WritePriority %v", err)
+	}
+	if err := WriteRstStream(client, &Framer{StreamID: 3}, CANCEL); err != nil {
+		t.Fatalf("Error: WriteRstStream %v", err)
+	}
+	if err := WritePing(client, &Framer{}, Ping{Ack: true, Data: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}); err != nil {
+		t.Fatalf("Error: WritePing %v", err)
+	}
+	if err := WriteGoAway(client, &Framer{}, GoAway{LastStreamId: 0x10001, Error: ENHANCE_YOUR_CALM, AdditionalDebugData: []byte("calm")}); err != nil {
+		t.Fatalf("Error: WriteGoAway %v", err)
+	}
+	if err := WriteWindowUpdate(client, &Framer{StreamID: 5}, 1<<31-1); err != nil {
+		t.Fatalf("Error: WriteWindowUpdate %v", err)
+	}
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 5 {
+		t.Fatalf("Error: want 5 frames, ans=%d", len(frames))
+	}
+	p, err := ParsePriority(&frames[0], payloads[0])
+	if err != nil || p.Dependency != 0x80000001 || p.Weight != 15 {
+		t.Fatalf("Error: ParsePriority %+v %v", p, err)
+	}
+	rs, err := ParseRstStream(&frames[1], payloads[1])
+	if err != nil || rs.Error != CANCEL || frames[1].StreamID != 3 {
+		t.Fatalf("Error: ParseRstStream %+v %v", rs, err)
+	}
+	if frames[2].FType != FramePing || frames[2].Flags != PING_ACK || !bytes.Equal(payloads[2], []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("Error: PING %+v %x", frames[2], payloads[2])
+	}
+	ping, err := ParsePing(&frames[2], payloads[2])
+	if err != nil || !ping.Ack || ping.Data != [8]byte{1, 2, 3, 4, 5, 6, 7, 8} {
+		t.Fatalf("Error: ParsePing %+v %v", ping, err)
+	}
+	ga, err := ParseGoAway(&frames[3], payloads[3])
+	if err != nil || ga.LastStreamId != 0x10001 || ga.Error != ENHANCE_YOUR_CALM || string(ga.AdditionalDebugData) != "calm" {
+		t.Fatalf("Error: ParseGoAway %+v %v", ga, err)
+	}
+	wu, err := ParseWindowUpdate(&frames[4], payloads[4])
+	if err != nil || wu.WindowSizeIncrement != 1<<31-1 || frames[4].StreamID != 5 {
+		t.Fatalf("Error: ParseWindowUpdate %+v %v", wu, err)
+	}
+
+	// invalid frames are not written
+	wire.Reset()
+	for name, err := range map[string]error{
+		"PRIORITY stream 0":      WritePriority(client, &Framer{}, Priority{}),
+		"PRIORITY self":          WritePriority(client, &Framer{StreamID: 3}, Priority{Dependency: 3}),
+		"RST_STREAM stream 0":    WriteRstStream(client, &Framer{}, CANCEL),
+		"PING stream 1":          WritePing(client, &Framer{StreamID: 1}, Ping{}),
+		"GOAWAY stream 1":        WriteGoAway(client, &Framer{StreamID: 1}, GoAway{}),
+		"WINDOW_UPDATE 0":        WriteWindowUpdate(client, &Framer{}, 0),
+		"WINDOW_UPDATE 2^31":     WriteWindowUpdate(client, &Framer{}, 1<<31),
+		"CONTINUATION stream 0":  WriteContinuation(client, &Framer{}, []byte{0x82}, true),
+		"GOAWAY too long":        WriteGoAway(client, &Framer{}, GoAway{AdditionalDebugData: make([]byte, DEFAULT_MAX_FRAME_SIZE)}),
+		"PUSH_PROMISE promised 0": WritePushPromise(client, &Framer{StreamID: 1}, PushPromise{}),
+	} {
+		if err == nil {
+			t.Fatalf("Error: %s doesn't send error", name)
+		}
+	}
+	if wire.Len() != 0 {
+		t.Fatalf("Error: invalid frames are written %x", wire.Bytes())
+	}
+}
+
+func TestWritePushPromise(t *testing.T) {
+	wire := &bytes.Buffer{}
+	server := NewServerConn(wire)
+	header := []hpack.KeyValue{
+		{Key: ":method", Value: "GET"},
+		{Key: ":path", Value: "/" + strings.Repeat("p", 40000)},
+	}
+	// the associated stream must be open
+	if err := WritePushPromise(server, &Framer{StreamID: 1}, PushPromise{PromisedID: 2, Header: header}); err == nil || wire.Len() != 0 {
+		t.Fatalf("Error: WritePushPromise on idle stream %v", err)
+	}
+	openStream(t, server, 1)
+	if err := WritePushPromise(server, &Framer{StreamID: 1}, PushPromise{PromisedID: 2, Header: header}); err != nil {
+		t.Fatalf("Error: WritePushPromise %v", err)
+	}
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) < 2 || frames[0].FType != FramePushPromise || frames[1].FType != FrameContinuation {
+		t.Fatalf("Error: WritePushPromise frames %+v", frames)
+	}
+	if binary.BigEndian.Uint32(payloads[0][0:4]) != 2 {
+		t.Fatalf("Error: WritePushPromise promised stream ID %x", payloads[0][0:4])
+	}
+	block := payloads[0][4:]
+	for i, f := range frames[1:] {
+		block = append(block, payloads[i+1]...)
+		if f.Length > DEFAULT_MAX_FRAME_SIZE || (f.Flags&CONTINUATION_END_HEADERS != 0) != (i == len(frames)-2) {
+			t.Fatalf("Error: WritePushPromise frame %d %+v", i+1, f)
+		}
+	}
+	kv, _, err := hpack.DecodeHeader(block, hpack.HpackConn{TableSizeLimit: 4096})
+	if err != nil || len(kv) != 2 || kv[1].Value != header[1].Value {
+		t.Fatalf("Error: WritePushPromise header block %v %v", kv, err)
+	}
+
+	// padded PUSH_PROMISE + CONTINUATION are parsed as one PushPromise
+	client := NewClientConn(&bytes.Buffer{})
+	wire.Reset()
+	server = NewServerConn(wire)
+	openStream(t, server, 3)
+	if err := WritePushPromise(server, &Framer{StreamID: 3}, PushPromise{PromisedID: 4, Header: header}, WithPadding(20)); err != nil {
+		t.Fatalf("Error: WritePushPromise %v", err)
+	}
+	frames, payloads = splitFrames(t, wire.Bytes())
+	if frames[0].Flags != PUSH_PROMISE_PADDED || frames[0].Length != DEFAULT_MAX_FRAME_SIZE || payloads[0][0] != 20 {
+		t.Fatalf("Error: WritePushPromise padded %+v", frames[0])
+	}
+	var v interface{}
+	for i := range frames {
+		if v, err = client.ParseFrame(&frames[i], payloads[i]); err != nil {
+			t.Fatalf("Error: ParseFrame %v", err)
+		}
+	}
+	pp, ok := v.(*PushPromise)
+	if !ok || pp.PromisedID != 4 || pp.Padding != 20 || len(pp.Header) != 2 || pp.Header[1].Value != header[1].Value {
+		t.Fatalf("Error: ParseFrame PUSH_PROMISE %+v", v)
+	}
+
+	// WithPadding(0) writes no padding over Connection.Padding
+	wire.Reset()
+	server.Padding = PadToMultiple(16)
+	openStream(t, server, 5)
+	small := []hpack.KeyValue{{Key: ":method", Value: "GET"}, {Key: ":path", Value: "/a"}}
+	if err := WritePushPromise(server, &Framer{StreamID: 5}, PushPromise{PromisedID: 6, Header: small}, WithPadding(0)); err != nil {
+		t.Fatalf("Error: WritePushPromise %v", err)
+	}
+	if err := WritePushPromise(server, &Framer{StreamID: 5}, PushPromise{PromisedID: 8, Header: small}); err != nil {
+		t.Fatalf("Error: WritePushPromise %v", err)
+	}
+	frames, payloads = splitFrames(t, wire.Bytes())
+	if len(frames) != 2 || frames[0].Flags != PUSH_PROMISE_END_HEADERS {
+		t.Fatalf("Error: WritePushPromise WithPadding(0) %+v", frames)
+	}
+	if frames[1].Flags != PUSH_PROMISE_END_HEADERS|PUSH_PROMISE_PADDED || (frames[1].Length-5)%16 != 0 {
+		t.Fatalf("Error: WritePushPromise Connection.Padding %+v", frames[1])
+	}
+
+	// CONTINUATION written by the caller
+	wire.Reset()
+	WriteContinuation(server, &Framer{StreamID: 1}, []byte{0x82}, true)
+	frames, _ = splitFrames(t, wire.Bytes())
+	if frames[0].FType != FrameContinuation || frames[0].Flags != CONTINUATION_END_HEADERS || frames[0].Length != 1 {
+		t.Fatalf("Error: WriteContinuation %+v", frames[0])
+	}
+}
+
+func TestSettings(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	d := Settings{Params: []Setting{
+		{HEADER_TABLE_SIZE, 0},
+		{ENABLE_PUSH, 0},
+		{MAX_CONCURRENT_STREAMS, 100},
+		{INITIAL_WINDOW_SIZE, 1<<31 - 1},
+		{MAX_FRAME_SIZE, 1<<24 - 1},
+		{MAX_HEADER_LIST_SIZE, 0x10000},
+	}}
+	if err := client.WriteSettings(&Framer{}, d); err != nil {
+		t.Fatalf("Error: WriteSettings %v", err)
+	}
+	client.WriteSettings(&Framer{}, Settings{Ack: true})
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 2 || frames[0].Length != 36 || frames[1].Length != 0 || frames[1].Flags != SETTINGS_ACK {
+		t.Fatalf("Error: WriteSettings frames %+v", frames)
+	}
+	s, err := ParseSettings(&frames[0], payloads[0])
+	if err != nil || fmt.Sprint(s.Params) != fmt.Sprint(d.Params) || s.Ack {
+		t.Fatalf("Error: ParseSettings want=%v, ans=%+v %v", d.Params, s, err)
+	}
+	if v, ok := s.Value(MAX_CONCURRENT_STREAMS); !ok || v != 100 {
+		t.Fatalf("Error: Settings.Value %d %v", v, ok)
+	}
+	if _, ok := (&Settings{}).Value(ENABLE_PUSH); ok {
+		t.Fatalf("Error: Settings.Value of an empty frame")
+	}
+
+	// unknown identifiers are ignored
+	b := []byte{0x00, 0x07, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0x00, 0x00, 0x00, 0x02, 0x00, 0x03, 0x00, 0x00, 0x00, 0x09}
+	s, err = ParseSettings(&Framer{FType: FrameSettings}, b)
+	if err != nil || len(s.Params) != 1 || s.Params[0] != (Setting{MAX_CONCURRENT_STREAMS, 9}) {
+		t.Fatalf("Error: ParseSettings unknown identifiers %+v %v", s, err)
+	}
+
+	// value ranges
+	for _, c := range []struct {
+		p    Setting
+		code ErrorCode
+	}{
+		{Setting{ENABLE_PUSH, 2}, PROTOCOL_ERROR},
+		{Setting{INITIAL_WINDOW_SIZE, 1 << 31}, FLOW_CONTROL_ERROR},
+		{Setting{MAX_FRAME_SIZE, 1<<14 - 1}, PROTOCOL_ERROR},
+		{Setting{MAX_FRAME_SIZE, 1 << 24}, PROTOCOL_ERROR},
+	} {
+		b := make([]byte, 6)
+		binary.BigEndian.PutUint16(b[0:2], uint16(c.p.Id))
+		binary.BigEndian.PutUint32(b[2:6], c.p.Value)
+		_, err := ParseSettings(&Framer{FType: FrameSettings}, append(make([]byte, 6), b...))
+		if e, ok := err.(ConnectionError); !ok || e.Code != c.code {
+			t.Fatalf("Error: ParseSettings %+v want=%s, ans=%v", c.p, c.code, err)
+		}
+		if err := client.WriteSettings(&Framer{}, Settings{Params: []Setting{c.p}}); err == nil {
+			t.Fatalf("Error: WriteSettings %+v doesn't send error", c.p)
+		}
+	}
+}
+
+func TestWritePadding(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	server := NewServerConn(&bytes.Buffer{})
+	header := []hpack.KeyValue{{Key: ":method", Value: "GET"}, {Key: "x-custom", Value: "value"}}
+
+	openLocalStream(t, client, 1)
+	WriteData(client, &Framer{StreamID: 1}, []byte("hello"), WithPadding(10))
+	WriteHeader(client, &Framer{StreamID: 3}, header, WithPadding(255))
+	// the policy of the connection, overridden by the option
+	client.Padding = PadToMultiple(16)
+	openLocalStream(t, client, 5)
+	WriteData(client, &Framer{StreamID: 5}, []byte("hello"))
+	WriteHeader(client, &Framer{StreamID: 7}, header)
+	openLocalStream(t, client, 9)
+	WriteData(client, &Framer{StreamID: 9}, []byte("hello"), WithPaddingPolicy(nil))
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 5 {
+		t.Fatalf("Error: want 5 frames, ans=%d", len(frames))
+	}
+	for i, c := range []struct {
+		padded bool
+		length uint32
+	}{
+		{true, 1 + 5 + 10},
+		{true, 0},
+		{true, 1 + 16},
+		{true, 0},
+		{false, 5},
+	} {
+		f := frames[i]
+		if (f.Flags&DATA_PADDED != 0) != c.padded || (c.length != 0 && f.Length != c.length) {
+			t.Fatalf("Error: frame %d %+v", i, f)
+		}
+		v, err := server.ParseFrame(&f, payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseFrame %d %v", i, err)
+		}
+		switch v := v.(type) {
+		case *Data:
+			if string(v.Content) != "hello" {
+				t.Fatalf("Error: ParseData %d %q", i, v.Content)
+			}
+		case *Header:
+			if len(v.Header) != 2 || v.Header[1] != header[1] {
+				t.Fatalf("Error: ParseHeader %d %v", i, v.Header)
+			}
+			if i == 1 && payloads[i][0] != 255 {
+				t.Fatalf("Error: HEADERS Pad Length %d", payloads[i][0])
+			}
+			if i == 3 && (f.Length-1)%16 != 0 {
+				t.Fatalf("Error: HEADERS PadToMultiple length %d", f.Length)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		n, length int
+		want      uint8
+	}{{16, 5, 11}, {16, 32, 0}, {1, 7, 0}, {256, 1, 255}} {
+		if p := PadToMultiple(c.n)(c.length); p != c.want {
+			t.Fatalf("Error: PadToMultiple(%d)(%d) want=%d, ans=%d", c.n, c.length, c.want, p)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if p := RandomPadding(8)(100); p > 8 {
+			t.Fatalf("Error: RandomPadding(8) %d", p)
+		}
+	}
+}
+
+func TestWritePaddingWindow(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	client.Padding = PadToMultiple(16)
+	s := client.NewStream()
+	openLocalStream(t, client, s.ID)
+	client.stateMu.Lock()
+	client.send.window = 30
+	client.stateMu.Unlock()
+
+	// 100 octets + 12 padded (113) don't fit in 30 octets of credit,
+	// the chunk is cut to 16 octets (a multiple of 16 without padding)
+	done := make(chan error, 1)
+	go func() {
+		done <- WriteData(client, &Framer{StreamID: s.ID}, make([]byte, 100))
+	}()
+	waitUntil(t, func() bool {
+		client.stateMu.Lock()
+		defer client.stateMu.Unlock()
+		return client.send.window == 14
+	})
+	client.handleWindowUpdate(&Framer{}, &WindowUpdate{1000})
+	if err := <-done; err != nil {
+		t.Fatalf("Error: WriteData %v", err)
+	}
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	if len(frames) != 2 {
+		t.Fatalf("Error: want 2 frames, ans=%d", len(frames))
+	}
+	total := 0
+	for i, f := range frames {
+		length := int(f.Length)
+		if f.Flags&DATA_PADDED != 0 {
+			length--
+		}
+		if length%16 != 0 {
+			t.Fatalf("Error: frame %d data + Padding %d is not a multiple of 16", i, length)
+		}
+		d, err := ParseData(&frames[i], payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseData %d %v", i, err)
+		}
+		total += len(d.Content)
+	}
+	if total != 100 || frames[0].Length != 16 || frames[1].Length != 1+84+12 {
+		t.Fatalf("Error: DATA %+v", frames)
+	}
+	// the credit is taken by the frames only
+	client.stateMu.Lock()
+	window := client.send.window
+	client.stateMu.Unlock()
+	if window != 30+1000-16-97 {
+		t.Fatalf("Error: connection window want=%d, ans=%d", 30+1000-16-97, window)
+	}
+}
+
+func TestWriteEndStream(t *testing.T) {
+	wire := &bytes.Buffer{}
+	server := NewServerConn(wire)
+	client := NewClientConn(&bytes.Buffer{})
+	openStream(t, server, 1)
+	openStream(t, server, 3)
+
+	// response: HEADERS -> DATA -> DATA -> HEADERS (trailers, END_STREAM)
+	WriteHeader(server, &Framer{StreamID: 1}, []hpack.KeyValue{{Key: ":status", Value: "200"}}, WithEndStream(false))
+	WriteData(server, &Framer{StreamID: 1}, []byte("hello, "), WithEndStream(false))
+	WriteData(server, &Framer{StreamID: 1}, []byte("world"), WithEndStream(false))
+	WriteHeader(server, &Framer{StreamID: 1}, []hpack.KeyValue{{Key: "grpc-status", Value: "0"}})
+	// long-lived stream: DATA without END_STREAM, then an empty DATA with END_STREAM
+	WriteData(server, &Framer{StreamID: 3}, []byte("event"), WithEndStream(false))
+	WriteData(server, &Framer{StreamID: 3}, nil)
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	want := []bool{false, false, false, true, false, true}
+	if len(frames) != len(want) {
+		t.Fatalf("Error: want %d frames, ans=%d", len(want), len(frames))
+	}
+	body := ""
+	for i := range frames {
+		v, err := client.ParseFrame(&frames[i], payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseFrame %d %v", i, err)
+		}
+		var eos bool
+		switch v := v.(type) {
+		case *Data:
+			eos = v.Eos
+			if frames[i].StreamID == 1 {
+				body += string(v.Content)
+			}
+		case *Header:
+			eos = v.Eos
+		}
+		if eos != want[i] {
+			t.Fatalf("Error: frame %d END_STREAM want=%v, ans=%v", i, want[i], eos)
+		}
+	}
+	if body != "hello, world" {
+		t.Fatalf("Error: body %q", body)
+	}
+}
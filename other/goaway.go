@@ -0,0 +1,111 @@
+package minihttp2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 6.8. GOAWAY
+//
+//  sent:     Shutdown sends GOAWAY with the last stream ID opened by the peer.
+//            the streams up to the ID are finished, the new streams of the
+//            peer are refused (REFUSED_STREAM), and the connection is closed
+//            when no stream is active.
+//  received: the streams of this endpoint above LastStreamId were not
+//            processed by the peer, they are closed with a retryable error
+//            (see Retryable). no stream can be opened any more.
+
+// ErrShutdown is returned by Serve and the writers after Shutdown.
+var ErrShutdown = errors.New("connection is shut down")
+
+// ErrGoAway is returned when a stream is opened after GOAWAY.
+var ErrGoAway = errors.New("connection is going away")
+
+// Retryable tells whether the request of a stream which failed with err was
+// not processed by the peer and can be sent again (e.g. on another connection).
+//  8.7. Request Reliability
+//   REFUSED_STREAM: by RST_STREAM, or the stream above the last stream ID of GOAWAY
+func Retryable(err error) bool {
+	e, ok := err.(StreamError)
+	return ok && e.Code == REFUSED_STREAM
+}
+
+// Err returns the error which closed the stream (nil if the stream is not
+// closed, or closed normally).
+func (s *Stream) Err() error {
+	s.con.stateMu.Lock()
+	defer s.con.stateMu.Unlock()
+	return s.err
+}
+
+// Shutdown closes the connection gracefully.
+// GOAWAY (NO_ERROR) is sent with the last stream ID opened by the peer, and
+// the connection is closed when all the active streams are finished.
+// when ctx is done before that, the connection is closed at once and ctx.Err()
+// is returned.
+func (con *Connection) Shutdown(ctx context.Context) error {
+	con.stateMu.Lock()
+	if con.err != nil {
+		con.stateMu.Unlock()
+		return con.err
+	}
+	con.goingAway = true
+	last := con.lastPeerStreamID
+	con.stateMu.Unlock()
+
+	if err := WriteGoAway(con, &Framer{}, GoAway{LastStreamId: last, Error: NO_ERROR}); err != nil {
+		return err
+	}
+
+	// the streams are closed by the goroutine reading frames (Serve)
+	finished := make(chan struct{})
+	go func() {
+		con.stateMu.Lock()
+		for con.err == nil && ctx.Err() == nil && con.activeStreams(true)+con.activeStreams(false) > 0 {
+			con.flowCond.Wait()
+		}
+		con.stateMu.Unlock()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// wake up the goroutine waiting for the streams
+		con.stateMu.Lock()
+		con.flowCond.Broadcast()
+		con.stateMu.Unlock()
+		<-finished
+	}
+
+	if con.setErr(ErrShutdown) {
+		if c, ok := con.R.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return err
+}
+
+// handleGoAway handles GOAWAY received from the peer.
+// the streams of this endpoint above LastStreamId are closed with REFUSED_STREAM.
+func (con *Connection) handleGoAway(ga *GoAway) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	// GOAWAY can be sent again with a lower ID
+	if !con.peerGoingAway || ga.LastStreamId < con.peerLastStreamID {
+		con.peerLastStreamID = ga.LastStreamId
+	}
+	con.peerGoingAway = true
+
+	for id, s := range con.streams {
+		if con.local(id) && id > con.peerLastStreamID {
+			s.err = StreamError{id, REFUSED_STREAM, fmt.Sprintf("not processed by the peer (GOAWAY %s)", ga.Error)}
+			con.closeStream(s)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package minihttp2
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+	"./hpack"
+)
+
+func TestShutdown(t *testing.T) {
+	client, server := connPair(t)
+	request := []hpack.KeyValue{{Key: ":method", Value: "POST"}}
+
+	// the server responds when the request body ends
+	serverDone := serve(server, func(f *Framer, v interface{}) error {
+		if d, ok := v.(*Data); ok && d.Eos {
+			return WriteHeader(server, &Framer{StreamID: f.StreamID}, []hpack.KeyValue{{Key: ":status", Value: "200"}})
+		}
+		return nil
+	})
+	goaway := make(chan *GoAway, 1)
+	serve(client, func(f *Framer, v interface{}) error {
+		if ga, ok := v.(*GoAway); ok {
+			goaway <- ga
+		}
+		return nil
+	})
+
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, request, WithEndStream(false))
+	waitUntil(t, func() bool { return server.Stream(s.ID) != nil })
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case ga := <-goaway:
+		if ga.LastStreamId != s.ID || ga.Error != NO_ERROR {
+			t.Fatalf("Error: GOAWAY %+v", ga)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: GOAWAY not received")
+	}
+
+	// no new stream, the stream in flight is finished
+	if err := WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, request); err != ErrGoAway {
+		t.Fatalf("Error: new stream after GOAWAY want=ErrGoAway, ans=%v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Error: Shutdown returned before the stream finished %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	WriteData(client, &Framer{StreamID: s.ID}, []byte("body"))
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Error: Shutdown %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: Shutdown didn't return")
+	}
+	if err := <-serverDone; err != ErrShutdown {
+		t.Fatalf("Error: Serve want=ErrShutdown, ans=%v", err)
+	}
+	waitUntil(t, func() bool { return s.State() == StateClosed })
+	if s.Err() != nil {
+		t.Fatalf("Error: stream error %v", s.Err())
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := NewServerConn(&bytes.Buffer{})
+	openStream(t, server, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Error: Shutdown want=context.DeadlineExceeded, ans=%v", err)
+	}
+	if server.Err() != ErrShutdown {
+		t.Fatalf("Error: Err want=ErrShutdown, ans=%v", server.Err())
+	}
+
+	// the streams opened after GOAWAY are refused
+	server = NewServerConn(&bytes.Buffer{})
+	openStream(t, server, 1)
+	server.goingAway = true
+	err := server.receiveFrame(&Framer{StreamID: 3}, &Header{})
+	if e, ok := err.(StreamError); !ok || e.Code != REFUSED_STREAM || !Retryable(err) {
+		t.Fatalf("Error: stream after GOAWAY want=REFUSED_STREAM, ans=%v", err)
+	}
+	if err := server.receiveFrame(&Framer{StreamID: 1}, &Data{Eos: true}); err != nil {
+		t.Fatalf("Error: DATA on the stream before GOAWAY %v", err)
+	}
+}
+
+func TestReceiveGoAway(t *testing.T) {
+	client := NewClientConn(&bytes.Buffer{})
+	header := []hpack.KeyValue{{Key: ":method", Value: "POST"}}
+	streams := []*Stream{client.NewStream(), client.NewStream(), client.NewStream()}
+	for _, s := range streams {
+		WriteHeader(client, &Framer{StreamID: s.ID}, header, WithEndStream(false))
+	}
+
+	client.handleGoAway(&GoAway{LastStreamId: 1, Error: NO_ERROR})
+
+	// stream 1 was processed by the peer
+	if streams[0].State() != StateOpen || streams[0].Err() != nil {
+		t.Fatalf("Error: stream 1 %v %v", streams[0].State(), streams[0].Err())
+	}
+	if err := WriteData(client, &Framer{StreamID: 1}, []byte("body")); err != nil {
+		t.Fatalf("Error: WriteData stream 1 %v", err)
+	}
+	// streams 3 and 5 can be sent again
+	for _, s := range streams[1:] {
+		if s.State() != StateClosed || !Retryable(s.Err()) {
+			t.Fatalf("Error: stream %d %v %v", s.ID, s.State(), s.Err())
+		}
+		if err := WriteData(client, &Framer{StreamID: s.ID}, []byte("body")); err != ErrStreamClosed {
+			t.Fatalf("Error: WriteData stream %d want=ErrStreamClosed, ans=%v", s.ID, err)
+		}
+	}
+	if err := WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, header); err != ErrGoAway {
+		t.Fatalf("Error: new stream after GOAWAY want=ErrGoAway, ans=%v", err)
+	}
+
+	// RST_STREAM (REFUSED_STREAM) is also retryable, other codes are not
+	if Retryable(StreamError{1, CANCEL, ""}) || Retryable(ConnectionError{REFUSED_STREAM, ""}) {
+		t.Fatalf("Error: Retryable")
+	}
+}
@@ -0,0 +1,107 @@
+package minihttp2
+
+import (
+	"math/rand"
+)
+
+// 10.7. Padding
+//  DATA, HEADERS and PUSH_PROMISE can be padded to hide the exact size of
+//  the content from traffic analysis.
+//
+// PaddingPolicy returns the octets of Padding for a frame carrying
+// length octets of data (or header block).
+type PaddingPolicy func(length int) uint8
+
+// PadToMultiple pads frames so that data + Padding is a multiple of n (n <= 256).
+func PadToMultiple(n int) PaddingPolicy {
+	return func(length int) uint8 {
+		if n <= 1 || length%n == 0 {
+			return 0
+		}
+		return uint8(n - length%n)
+	}
+}
+
+// RandomPadding pads frames with 0 to max octets chosen at random.
+func RandomPadding(max uint8) PaddingPolicy {
+	return func(length int) uint8 {
+		return uint8(rand.Intn(int(max) + 1))
+	}
+}
+
+// WriteOption changes how a frame is written by WriteData, WriteHeader
+// (padding and END_STREAM) and WritePushPromise (padding).
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	padding   PaddingPolicy // nil: Connection.Padding
+	endStream bool
+}
+
+// WithPadding writes the frame with n octets of Padding.
+func WithPadding(n uint8) WriteOption {
+	return func(o *writeOptions) {
+		o.padding = func(int) uint8 { return n }
+	}
+}
+
+// WithEndStream sets END_STREAM on the frame when end is true (default).
+// false keeps the stream open for more frames, e.g.
+//  HEADERS -> DATA ... -> DATA (END_STREAM)            response with a body
+//  HEADERS -> DATA ... -> HEADERS (END_STREAM)         trailers
+func WithEndStream(end bool) WriteOption {
+	return func(o *writeOptions) {
+		o.endStream = end
+	}
+}
+
+// WithPaddingPolicy pads the frame by p instead of Connection.Padding.
+func WithPaddingPolicy(p PaddingPolicy) WriteOption {
+	return func(o *writeOptions) {
+		o.padding = p
+	}
+}
+
+func (con *Connection) writeOptions(opts []WriteOption) writeOptions {
+	o := writeOptions{padding: con.Padding, endStream: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// paddingFor returns the octets of Padding for length octets of content.
+func (o writeOptions) paddingFor(length int) int {
+	if o.padding == nil {
+		return 0
+	}
+	return int(o.padding(length))
+}
+
+// padLength returns the octets of Pad Length and Padding in a frame padded by pad.
+func padLength(pad int) int {
+	if pad == 0 {
+		return 0
+	}
+	return 1 + pad
+}
+
+// fitPadding returns the largest chunk of at most n octets which fits in
+// size octets with its Pad Length and Padding, and the Padding of the chunk.
+// the chunk is not padded when no padded chunk fits.
+func (o writeOptions) fitPadding(n, size int) (int, int) {
+	for m := n; m > 0; m-- {
+		if pad := o.paddingFor(m); m+padLength(pad) <= size {
+			return m, pad
+		}
+	}
+	if n == 0 {
+		if pad := o.paddingFor(0); padLength(pad) <= size {
+			return 0, pad
+		}
+	}
+	if n > size {
+		n = size
+	}
+	return n, 0
+}
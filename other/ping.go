@@ -0,0 +1,61 @@
+package minihttp2
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// Ping sends PING and waits for its ACK, and returns the round-trip time.
+// Serve must be running to receive the ACK.
+func (con *Connection) Ping(ctx context.Context) (time.Duration, error) {
+	con.stateMu.Lock()
+	if con.err != nil {
+		con.stateMu.Unlock()
+		return 0, con.err
+	}
+	// Opaque Data identifies the PING (a sequence number)
+	con.pingSeq++
+	p := Ping{}
+	binary.BigEndian.PutUint64(p.Data[:], con.pingSeq)
+	ack := make(chan struct{})
+	con.pings[p.Data] = ack
+	con.stateMu.Unlock()
+
+	defer func() {
+		con.stateMu.Lock()
+		delete(con.pings, p.Data)
+		con.stateMu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := WritePing(con, &Framer{}, p); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ack:
+		return time.Since(start), nil
+	case <-con.closed:
+		return 0, con.Err()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// handlePing handles PING received from the peer.
+// 6.7. PING
+//  PING:     ACK with the same Opaque Data is sent back
+//  PING ACK: the waiting Connection.Ping returns (unknown ACKs are ignored)
+func (con *Connection) handlePing(p *Ping) error {
+	if !p.Ack {
+		return WritePing(con, &Framer{}, Ping{Ack: true, Data: p.Data})
+	}
+
+	con.stateMu.Lock()
+	if ack, ok := con.pings[p.Data]; ok {
+		close(ack)
+		delete(con.pings, p.Data)
+	}
+	con.stateMu.Unlock()
+	return nil
+}
@@ -0,0 +1,46 @@
+package minihttp2
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	client, server := connPair(t)
+	serve(server, nil)
+	serve(client, nil)
+
+	// the server replies PING ACK automatically
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		rtt, err := client.Ping(ctx)
+		cancel()
+		if err != nil || rtt <= 0 {
+			t.Fatalf("Error: Ping rtt=%v err=%v", rtt, err)
+		}
+	}
+	client.stateMu.Lock()
+	n := len(client.pings)
+	client.stateMu.Unlock()
+	if n != 0 {
+		t.Fatalf("Error: Ping %d pings left", n)
+	}
+}
+
+func TestPingCancel(t *testing.T) {
+	// the server doesn't read frames, ACK never arrives
+	client, _ := connPair(t)
+	serve(client, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Error: Ping want=context.DeadlineExceeded, ans=%v", err)
+	}
+
+	// unknown ACK is ignored
+	if err := client.handlePing(&Ping{Ack: true, Data: [8]byte{0xff}}); err != nil {
+		t.Fatalf("Error: handlePing %v", err)
+	}
+}
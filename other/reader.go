@@ -0,0 +1,70 @@
+package minihttp2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FrameReader reads frames from the reader of a Connection.
+//  9 octets frame header -> payload (Length octets) -> Connection.ParseFrame
+// the payload buffer is reused, so byte slices in the returned frame
+// (e.g. Data.Content) are valid only until the next ReadFrame.
+type FrameReader struct {
+	con    *Connection
+	r      io.Reader
+	header [9]byte
+	buf    []byte
+}
+
+// NewFrameReader returns a FrameReader reading con.R.
+func NewFrameReader(con *Connection) *FrameReader {
+	return &FrameReader{con: con, r: con.R}
+}
+
+// ReadFrameHeader reads a frame header and its payload.
+// io.EOF is returned only when the reader ends between frames.
+func (fr *FrameReader) ReadFrameHeader() (*Framer, []byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return nil, nil, err
+	}
+	frame := &Framer{
+		Length:   binary.BigEndian.Uint32(fr.header[0:4]) >> 8,
+		FType:    FrameType(fr.header[3]),
+		Flags:    fr.header[4],
+		StreamID: binary.BigEndian.Uint32(fr.header[5:9]) & (1<<31 - 1),
+	}
+
+	// 4.2. Frame Size
+	//  a frame exceeding SETTINGS_MAX_FRAME_SIZE (sent by this endpoint) is FRAME_SIZE_ERROR
+	if max := fr.con.localSettings[MAX_FRAME_SIZE]; max != 0 && frame.Length > max {
+		return nil, nil, ConnectionError{FRAME_SIZE_ERROR, fmt.Sprintf("%s frame length %d exceeds %d", frameName[frame.FType], frame.Length, max)}
+	}
+
+	if uint32(cap(fr.buf)) < frame.Length {
+		fr.buf = make([]byte, frame.Length)
+	}
+	payload := fr.buf[:frame.Length]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return frame, payload, nil
+}
+
+// ReadFrame reads the next frame and returns it with the parsed value
+// (see Connection.ParseFrame). the value is nil for the fragments of a
+// header block until END_HEADERS.
+func (fr *FrameReader) ReadFrame() (*Framer, interface{}, error) {
+	frame, payload, err := fr.ReadFrameHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := fr.con.ParseFrame(frame, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return frame, v, nil
+}
@@ -0,0 +1,90 @@
+package minihttp2
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"./hpack"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestFrameReader(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+
+	header := []hpack.KeyValue{
+		{Key: ":method", Value: "POST"},
+		{Key: "x-large", Value: strings.Repeat("0123456789", 3000)},
+	}
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, header, WithEndStream(false))
+	data := strings.Repeat("d", 3*DEFAULT_MAX_FRAME_SIZE)
+	WriteData(client, &Framer{StreamID: s.ID}, []byte(data))
+
+	// frames arrive one byte at a time
+	server := NewServerConn(readWriter{iotest.OneByteReader(wire), ioutil.Discard})
+	fr := NewFrameReader(server)
+
+	var h *Header
+	for h == nil {
+		f, v, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error: ReadFrame %v", err)
+		}
+		if f.StreamID != s.ID {
+			t.Fatalf("Error: ReadFrame stream id want=%d, ans=%d", s.ID, f.StreamID)
+		}
+		if v != nil {
+			h = v.(*Header)
+		}
+	}
+	if len(h.Header) != 2 || h.Header[1].Value != header[1].Value {
+		t.Fatalf("Error: ReadFrame header %v", h.Header)
+	}
+
+	// DATA is split by SETTINGS_MAX_FRAME_SIZE, END_STREAM on the last frame
+	body := ""
+	for i := 0; i < 3; i++ {
+		f, v, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("Error: ReadFrame %v", err)
+		}
+		d, ok := v.(*Data)
+		if !ok || f.Length != DEFAULT_MAX_FRAME_SIZE || d.Eos != (i == 2) {
+			t.Fatalf("Error: ReadFrame data %+v %v", f, v)
+		}
+		body += string(d.Content)
+	}
+	if body != data {
+		t.Fatalf("Error: ReadFrame data %q", body)
+	}
+
+	// end of the stream between frames
+	if _, _, err := fr.ReadFrame(); err != io.EOF {
+		t.Fatalf("Error: ReadFrame want=io.EOF, ans=%v", err)
+	}
+}
+
+func TestFrameReaderError(t *testing.T) {
+	// truncated payload
+	b := []byte{0x00, 0x00, 0x08, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02}
+	server := NewServerConn(readWriter{bytes.NewReader(b), ioutil.Discard})
+	if _, _, err := NewFrameReader(server).ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Error: ReadFrame want=io.ErrUnexpectedEOF, ans=%v", err)
+	}
+
+	// frame larger than SETTINGS_MAX_FRAME_SIZE (16384)
+	b = []byte{0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	server = NewServerConn(readWriter{bytes.NewReader(b), ioutil.Discard})
+	_, _, err := NewFrameReader(server).ReadFrame()
+	if e, ok := err.(ConnectionError); !ok || e.Code != FRAME_SIZE_ERROR {
+		t.Fatalf("Error: ReadFrame want=FRAME_SIZE_ERROR, ans=%v", err)
+	}
+}
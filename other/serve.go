@@ -0,0 +1,100 @@
+package minihttp2
+
+// Handler handles a frame read by Connection.Serve.
+// v is the parsed frame (see Connection.ParseFrame).
+// StreamError resets the stream, and other errors close the connection.
+type Handler func(f *Framer, v interface{}) error
+
+// Serve reads frames from R until the connection is closed.
+// SETTINGS, PING and WINDOW_UPDATE are handled by the connection,
+// the other frames are passed to h (GOAWAY after closing the refused streams).
+// the frames on a stream reset by this endpoint are ignored.
+//
+// 5.4. Error Handling
+//  StreamError:     RST_STREAM is sent and the connection is kept
+//  ConnectionError: GOAWAY is sent and Serve returns the error
+// when the connection was closed by fail (e.g. SETTINGS_TIMEOUT),
+// that error is returned instead of the read error.
+func (con *Connection) Serve(h Handler) error {
+	fr := NewFrameReader(con)
+	for {
+		f, v, err := fr.ReadFrame()
+		if err == nil {
+			err = con.handleFrame(f, v, h)
+		}
+		if err == nil {
+			continue
+		}
+
+		if e := con.Err(); e != nil {
+			return e
+		}
+		switch err.(type) {
+		case ConnectionError, StreamError:
+		default:
+			if f == nil {
+				// read error (e.g. io.EOF), the blocked writers return err
+				con.setErr(err)
+				return err
+			}
+		}
+		if code, streamID, stream := ErrorCodeOf(err); stream {
+			if err := WriteRstStream(con, &Framer{StreamID: streamID}, code); err != nil {
+				return err
+			}
+			continue
+		}
+		con.fail(err)
+		return err
+	}
+}
+
+func (con *Connection) handleFrame(f *Framer, v interface{}, h Handler) error {
+	if v == nil {
+		// a fragment of a header block or an unknown frame
+		return nil
+	}
+	// 6.9. DATA is counted against the connection window in any state of
+	// the stream, the credit of DATA which is not handled is returned at once
+	_, data := v.(*Data)
+	if data {
+		if err := con.receiveData(f); err != nil {
+			return con.discardData(f, err)
+		}
+	}
+	// 5.1. Stream States
+	if err := con.receiveFrame(f, v); err != nil {
+		if data {
+			err = con.discardData(f, err)
+		}
+		if err == errStreamReset {
+			return nil
+		}
+		return err
+	}
+
+	switch v := v.(type) {
+	case *Settings:
+		return con.handleSettings(v)
+	case *Ping:
+		return con.handlePing(v)
+	case *WindowUpdate:
+		return con.handleWindowUpdate(f, v)
+	case *GoAway:
+		// passed to h after the streams are closed
+		con.handleGoAway(v)
+	case *Data:
+		// the credit is returned after h handled the data
+		// (the connection credit also when h fails)
+		if h != nil {
+			if err := h(f, v); err != nil {
+				return con.discardData(f, err)
+			}
+		}
+		return con.consumeData(f, v.Eos)
+	}
+	if h == nil {
+		return nil
+	}
+	return h(f, v)
+}
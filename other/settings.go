@@ -0,0 +1,184 @@
+package minihttp2
+
+import (
+	"io"
+	"time"
+)
+
+// 6.5.3. Settings Synchronization
+//
+//  this endpoint                         peer
+//       |  SETTINGS (queued)              |
+//       |-------------------------------->|  applied to remoteSettings
+//       |                   SETTINGS ACK  |
+//       |<--------------------------------|
+//  applied to localSettings
+//
+// the values sent are applied only when the peer acknowledges them.
+// ACKs arrive in the order of SETTINGS, so the oldest pending one is applied.
+// when ACK doesn't arrive within SettingsTimeout,
+// the connection is closed with SETTINGS_TIMEOUT.
+type pendingSettings struct {
+	params []Setting
+	timer  *time.Timer
+}
+
+// SendSettings sends SETTINGS with params and waits for ACK in the background.
+func (con *Connection) SendSettings(params ...Setting) error {
+	ps := &pendingSettings{params: params}
+
+	// queued before writing, ACK may arrive before WriteSettings returns
+	con.stateMu.Lock()
+	if con.err != nil {
+		con.stateMu.Unlock()
+		return con.err
+	}
+	con.unackedSettings = append(con.unackedSettings, ps)
+	if con.SettingsTimeout > 0 {
+		ps.timer = time.AfterFunc(con.SettingsTimeout, func() { con.settingsTimeout(ps) })
+	}
+	con.stateMu.Unlock()
+
+	if err := con.WriteSettings(&Framer{}, Settings{Params: params}); err != nil {
+		con.removeSettings(ps)
+		return err
+	}
+	return nil
+}
+
+// removeSettings removes ps from the queue (e.g. writing ps failed).
+func (con *Connection) removeSettings(ps *pendingSettings) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	for i, p := range con.unackedSettings {
+		if p == ps {
+			con.unackedSettings = append(con.unackedSettings[:i], con.unackedSettings[i+1:]...)
+			break
+		}
+	}
+	if ps.timer != nil {
+		ps.timer.Stop()
+	}
+}
+
+// settingsTimeout is called when ps is not acknowledged within SettingsTimeout.
+func (con *Connection) settingsTimeout(ps *pendingSettings) {
+	con.stateMu.Lock()
+	pending := false
+	for _, p := range con.unackedSettings {
+		if p == ps {
+			pending = true
+		}
+	}
+	con.stateMu.Unlock()
+
+	if pending {
+		con.fail(ConnectionError{SETTINGS_TIMEOUT, "SETTINGS ACK was not received"})
+	}
+}
+
+// PendingSettings returns the number of SETTINGS waiting for ACK.
+func (con *Connection) PendingSettings() int {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	return len(con.unackedSettings)
+}
+
+// handleSettings handles SETTINGS received from the peer.
+//  ACK:   the oldest pending SETTINGS is applied to localSettings
+//  other: applied to remoteSettings at once and acknowledged
+func (con *Connection) handleSettings(s *Settings) error {
+	if s.Ack {
+		con.stateMu.Lock()
+		if len(con.unackedSettings) == 0 {
+			con.stateMu.Unlock()
+			return ConnectionError{PROTOCOL_ERROR, "unexpected SETTINGS ACK"}
+		}
+		ps := con.unackedSettings[0]
+		con.unackedSettings = con.unackedSettings[1:]
+		if ps.timer != nil {
+			ps.timer.Stop()
+		}
+
+		// localSettings and receiveHeaderCache are changed only by the goroutine reading frames
+		for _, p := range ps.params {
+			switch p.Id {
+			case HEADER_TABLE_SIZE:
+				con.receiveHeaderCache.SetTableSizeLimit(p.Value)
+			case INITIAL_WINDOW_SIZE:
+				con.setInitialRecvWindow(con.localSettings[p.Id], p.Value)
+			}
+			con.localSettings[p.Id] = p.Value
+		}
+		con.stateMu.Unlock()
+		return nil
+	}
+
+	// the new values are used by the frames written after this
+	// (e.g. HEADERS starts with Dynamic Table Size Update)
+	con.mu.Lock()
+	for _, p := range s.Params {
+		con.remoteSettings[p.Id] = p.Value
+		if p.Id == HEADER_TABLE_SIZE {
+			con.sendHeaderCache.SetTableSizeLimit(p.Value)
+		}
+	}
+	con.mu.Unlock()
+
+	if v, ok := s.Value(INITIAL_WINDOW_SIZE); ok {
+		con.stateMu.Lock()
+		err := con.setInitialSendWindow(v)
+		con.stateMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return con.WriteSettings(&Framer{}, Settings{Ack: true})
+}
+
+// fail closes the connection with the connection error err.
+// GOAWAY (with the last stream ID opened by the peer) is sent, and R is closed (if it's io.Closer)
+// to stop the goroutine reading frames. only the first error is kept.
+func (con *Connection) fail(err error) {
+	if !con.setErr(err) {
+		return
+	}
+	con.stateMu.Lock()
+	last := con.lastPeerStreamID
+	con.stateMu.Unlock()
+
+	code, _, _ := ErrorCodeOf(err)
+	WriteGoAway(con, &Framer{}, GoAway{LastStreamId: last, Error: code})
+	if c, ok := con.R.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// setErr keeps err as the error which closed the connection,
+// false is returned when the connection is already closed.
+func (con *Connection) setErr(err error) bool {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	if con.err != nil {
+		return false
+	}
+	con.err = err
+	close(con.closed)
+	for _, ps := range con.unackedSettings {
+		if ps.timer != nil {
+			ps.timer.Stop()
+		}
+	}
+	con.unackedSettings = nil
+	// blocked writers return err
+	con.flowCond.Broadcast()
+	return true
+}
+
+// Err returns the connection error which closed the connection (nil if not closed).
+func (con *Connection) Err() error {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	return con.err
+}
@@ -0,0 +1,182 @@
+package minihttp2
+
+import (
+	"net"
+	"testing"
+	"time"
+	"./hpack"
+)
+
+// connPair returns a connected pair of client and server connections.
+func connPair(t *testing.T) (*Connection, *Connection) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: Listen %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Error: Accept %v", err)
+		}
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error: Dial %v", err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return NewClientConn(c), NewServerConn(s)
+}
+
+func serve(con *Connection, h Handler) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- con.Serve(h)
+	}()
+	return done
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Error: timeout")
+}
+
+func TestSettingsNegotiation(t *testing.T) {
+	client, server := connPair(t)
+
+	headers := make(chan *Header, 1)
+	serve(server, func(f *Framer, v interface{}) error {
+		if h, ok := v.(*Header); ok {
+			headers <- h
+		}
+		return nil
+	})
+	serve(client, nil)
+
+	// applied to localSettings only after ACK
+	if err := client.SendSettings(Setting{HEADER_TABLE_SIZE, 256}, Setting{MAX_FRAME_SIZE, 1 << 15}); err != nil {
+		t.Fatalf("Error: SendSettings %v", err)
+	}
+	waitUntil(t, func() bool { return client.PendingSettings() == 0 })
+	client.stateMu.Lock()
+	if client.localSettings[HEADER_TABLE_SIZE] != 256 || client.localSettings[MAX_FRAME_SIZE] != 1<<15 {
+		t.Fatalf("Error: localSettings %v", client.localSettings)
+	}
+	if client.receiveHeaderCache.TableSizeLimit != 256 {
+		t.Fatalf("Error: decoder limit want=256, ans=%d", client.receiveHeaderCache.TableSizeLimit)
+	}
+	client.stateMu.Unlock()
+
+	// the peer applied them at once (the SETTINGS is before its ACK)
+	server.mu.Lock()
+	limit, frameSize := server.sendHeaderCache.TableSizeLimit, server.maxFrameSize()
+	server.mu.Unlock()
+	if limit != 256 || frameSize != 1<<15 {
+		t.Fatalf("Error: remoteSettings limit=%d max frame size=%d", limit, frameSize)
+	}
+
+	// the server lowers the table size of the client's encoder:
+	// the next HEADERS starts with Dynamic Table Size Update
+	if err := server.SendSettings(Setting{HEADER_TABLE_SIZE, 0}); err != nil {
+		t.Fatalf("Error: SendSettings %v", err)
+	}
+	waitUntil(t, func() bool { return server.PendingSettings() == 0 })
+	header := []hpack.KeyValue{{Key: ":method", Value: "GET"}, {Key: "x-custom", Value: "value"}}
+	if err := WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, header); err != nil {
+		t.Fatalf("Error: WriteHeader %v", err)
+	}
+	select {
+	case h := <-headers:
+		if len(h.Header) != 2 || h.Header[1] != header[1] {
+			t.Fatalf("Error: HEADERS %v", h.Header)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: HEADERS not received")
+	}
+	client.mu.Lock()
+	stats := client.sendHeaderCache.Stats()
+	client.mu.Unlock()
+	if stats.SizeUpdates != 1 || len(client.sendHeaderCache.DynamicTable) != 0 {
+		t.Fatalf("Error: encoder stats %+v", stats)
+	}
+}
+
+func TestSettingsTimeout(t *testing.T) {
+	client, server := connPair(t)
+	client.SettingsTimeout = 50 * time.Millisecond
+
+	// the server reads frames but never acknowledges SETTINGS
+	goaway := make(chan *GoAway, 1)
+	go func() {
+		fr := NewFrameReader(server)
+		for {
+			_, v, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if ga, ok := v.(*GoAway); ok {
+				goaway <- ga
+				return
+			}
+		}
+	}()
+	done := serve(client, nil)
+
+	if err := client.SendSettings(Setting{INITIAL_WINDOW_SIZE, 1 << 20}); err != nil {
+		t.Fatalf("Error: SendSettings %v", err)
+	}
+	select {
+	case err := <-done:
+		if e, ok := err.(ConnectionError); !ok || e.Code != SETTINGS_TIMEOUT {
+			t.Fatalf("Error: Serve want=SETTINGS_TIMEOUT, ans=%v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: Serve didn't return")
+	}
+	select {
+	case ga := <-goaway:
+		if ga.Error != SETTINGS_TIMEOUT {
+			t.Fatalf("Error: GOAWAY want=SETTINGS_TIMEOUT, ans=%v", ga.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: GOAWAY not received")
+	}
+	if client.localSettings[INITIAL_WINDOW_SIZE] != 65535 {
+		t.Fatalf("Error: unacknowledged settings applied %v", client.localSettings)
+	}
+	if err := client.SendSettings(); err == nil {
+		t.Fatalf("Error: SendSettings after the connection error")
+	}
+}
+
+func TestUnexpectedSettingsAck(t *testing.T) {
+	client, server := connPair(t)
+	done := serve(server, nil)
+
+	if err := client.WriteSettings(&Framer{}, Settings{Ack: true}); err != nil {
+		t.Fatalf("Error: WriteSettings %v", err)
+	}
+	select {
+	case err := <-done:
+		if e, ok := err.(ConnectionError); !ok || e.Code != PROTOCOL_ERROR {
+			t.Fatalf("Error: Serve want=PROTOCOL_ERROR, ans=%v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Error: Serve didn't return")
+	}
+}
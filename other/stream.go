@@ -0,0 +1,371 @@
+package minihttp2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 5.1. Stream States
+//
+//                              +--------+
+//                      send PP |        | recv PP
+//                     ,--------+  idle  +--------.
+//                    /         |        |         \
+//                   v          +--------+          v
+//            +----------+          |           +----------+
+//            |          |          | send H /  |          |
+//     ,------+ reserved |          | recv H    | reserved +------.
+//     |      | (local)  |          |           | (remote) |      |
+//     |      +---+------+          v           +------+---+      |
+//     |          |             +--------+             |          |
+//     |          |     recv ES |        | send ES     |          |
+//     |   send H |     ,-------+  open  +-------.     | recv H   |
+//     |          |    /        |        |        \    |          |
+//     |          v   v         +---+----+         v   v          |
+//     |      +----------+          |           +----------+      |
+//     |      |   half-  |          |           |   half-  |      |
+//     |      |  closed  |          | send R /  |  closed  |      |
+//     |      | (remote) |          | recv R    | (local)  |      |
+//     |      +----+-----+          |           +-----+----+      |
+//     |           |                |                 |           |
+//     |           | send ES /      |       recv ES / |           |
+//     |           |  send R /      v        send R / |           |
+//     |           |  recv R    +--------+   recv R   |           |
+//     | send R /  `----------->|        |<-----------'  send R / |
+//     | recv R                 | closed |               recv R   |
+//     `----------------------->|        |<-----------------------'
+//                              +--------+
+//
+//  H: HEADERS, PP: PUSH_PROMISE, ES: END_STREAM, R: RST_STREAM
+type StreamState uint8
+
+const (
+	StateIdle StreamState = iota
+	StateReservedLocal
+	StateReservedRemote
+	StateOpen
+	StateHalfClosedLocal
+	StateHalfClosedRemote
+	StateClosed
+)
+
+var streamStateName = map[StreamState]string{
+	StateIdle:             "idle",
+	StateReservedLocal:    "reserved (local)",
+	StateReservedRemote:   "reserved (remote)",
+	StateOpen:             "open",
+	StateHalfClosedLocal:  "half-closed (local)",
+	StateHalfClosedRemote: "half-closed (remote)",
+	StateClosed:           "closed",
+}
+
+func (s StreamState) String() string {
+	if name, ok := streamStateName[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("StreamState(%d)", uint8(s))
+}
+
+// ErrStreamClosed is returned when a frame is written on a stream
+// which can't send any more (half-closed (local) or closed).
+// the writer blocked on a stream closed by RST_STREAM or GOAWAY returns
+// Stream.Err instead.
+var ErrStreamClosed = errors.New("stream closed")
+
+// errStreamReset is returned by receiveFrame for a frame on a stream reset by
+// this endpoint. the peer may have sent it before receiving RST_STREAM, and
+// it is ignored (5.1. closed).
+var errStreamReset = errors.New("frame on a stream reset by this endpoint")
+
+// State returns the current state of the stream.
+func (s *Stream) State() StreamState {
+	s.con.stateMu.Lock()
+	defer s.con.stateMu.Unlock()
+	return s.state
+}
+
+// local tells whether the stream id is initiated by this endpoint.
+//  client: odd, server: even
+func (con *Connection) local(id uint32) bool {
+	return (id%2 == 1) == (con.role == RoleClient)
+}
+
+// lookup returns the stream of id and its state.
+// closed streams are removed from streams, and a stream ID lower than the
+// IDs used so far is closed. stateMu must be held.
+func (con *Connection) lookup(id uint32) (*Stream, StreamState) {
+	if s, ok := con.streams[id]; ok {
+		return s, s.state
+	}
+	if con.local(id) && id < con.nextStreamID || !con.local(id) && id <= con.lastPeerStreamID {
+		return nil, StateClosed
+	}
+	return nil, StateIdle
+}
+
+// closeStream moves s to closed, the blocked writers of s return ErrStreamClosed.
+// stateMu must be held.
+func (con *Connection) closeStream(s *Stream) {
+	s.state = StateClosed
+	delete(con.streams, s.ID)
+	con.flowCond.Broadcast()
+}
+
+// activeStreams counts the open and half-closed streams initiated by
+// this endpoint (local) or the peer. stateMu must be held.
+func (con *Connection) activeStreams(local bool) uint32 {
+	n := uint32(0)
+	for id, s := range con.streams {
+		switch s.state {
+		case StateOpen, StateHalfClosedLocal, StateHalfClosedRemote:
+			if con.local(id) == local {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// endStream moves s by END_STREAM sent (local) or received.
+//  open -> half-closed, half-closed -> closed
+func (con *Connection) endStream(s *Stream, local bool) {
+	switch {
+	case s.state == StateOpen && local:
+		s.state = StateHalfClosedLocal
+	case s.state == StateOpen:
+		s.state = StateHalfClosedRemote
+	default:
+		con.closeStream(s)
+	}
+}
+
+// sendHeaders checks and moves the stream state for HEADERS written by
+// this endpoint. con.mu must be held (remoteSettings).
+//
+// the frames written on a stream unknown to the connection (idle) aren't
+// checked except MAX_CONCURRENT_STREAMS, the peer reports a wrong frame.
+func (con *Connection) sendHeaders(id uint32, eos bool) error {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	s, state := con.lookup(id)
+	switch state {
+	case StateIdle:
+		// 6.8. no stream is opened after GOAWAY
+		if con.local(id) && (con.goingAway || con.peerGoingAway) {
+			return ErrGoAway
+		}
+		// 5.1.2. Stream Concurrency
+		if max, ok := con.remoteSettings[MAX_CONCURRENT_STREAMS]; ok && con.activeStreams(con.local(id)) >= max {
+			return StreamError{id, REFUSED_STREAM, "SETTINGS_MAX_CONCURRENT_STREAMS of the peer is reached"}
+		}
+		if s == nil {
+			s = con.newStream(id)
+		}
+		if con.local(id) && id >= con.nextStreamID {
+			con.nextStreamID = id + 2
+		}
+		s.state = StateOpen
+	case StateReservedLocal:
+		s.state = StateHalfClosedRemote
+	case StateOpen, StateHalfClosedRemote:
+	default:
+		return ErrStreamClosed
+	}
+	if eos {
+		con.endStream(s, true)
+	}
+	return nil
+}
+
+// sendPushPromise reserves the promised stream (reserved (local)).
+// the associated stream must be open or half-closed (remote).
+func (con *Connection) sendPushPromise(id, promisedID uint32) error {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	switch _, state := con.lookup(id); state {
+	case StateOpen, StateHalfClosedRemote:
+	case StateIdle:
+		return StreamError{id, PROTOCOL_ERROR, "PUSH_PROMISE on idle stream"}
+	default:
+		return ErrStreamClosed
+	}
+	p, state := con.lookup(promisedID)
+	if state != StateIdle {
+		return StreamError{promisedID, PROTOCOL_ERROR, "promised stream is not idle"}
+	}
+	if p == nil {
+		p = con.newStream(promisedID)
+	}
+	p.state = StateReservedLocal
+	return nil
+}
+
+// sendEndStream moves the stream by END_STREAM of DATA written by this endpoint.
+func (con *Connection) sendEndStream(id uint32) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	if s, state := con.lookup(id); state == StateOpen || state == StateHalfClosedRemote {
+		con.endStream(s, true)
+	}
+}
+
+// number of the streams reset by this endpoint which are remembered.
+// the peer stops sending on the stream soon after RST_STREAM arrives,
+// so only the latest ones are kept.
+const MAX_RESET_STREAMS = 100
+
+// sendRstStream closes the stream, the frames received on it afterwards are ignored.
+func (con *Connection) sendRstStream(id uint32) {
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+	if s, _ := con.lookup(id); s != nil {
+		con.closeStream(s)
+	}
+	if con.isReset(id) {
+		return
+	}
+	con.resetStreams = append(con.resetStreams, id)
+	if len(con.resetStreams) > MAX_RESET_STREAMS {
+		con.resetStreams = con.resetStreams[1:]
+	}
+}
+
+// isReset tells whether the stream was reset by this endpoint recently.
+// stateMu must be held.
+func (con *Connection) isReset(id uint32) bool {
+	for _, r := range con.resetStreams {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveFrame checks whether the frame received on a stream is allowed in
+// the state of the stream, and moves the state (5.1. Stream States).
+// v is the parsed frame (see ParseFrame).
+func (con *Connection) receiveFrame(f *Framer, v interface{}) error {
+	if f.StreamID == 0 {
+		return nil
+	}
+	con.stateMu.Lock()
+	defer con.stateMu.Unlock()
+
+	s, state := con.lookup(f.StreamID)
+	if state == StateClosed && con.isReset(f.StreamID) {
+		return errStreamReset
+	}
+	name := frameName[f.FType]
+	switch v.(type) {
+	case *Priority:
+		// PRIORITY is allowed in any state
+		return nil
+	case *RstStream:
+		if state == StateIdle {
+			return ConnectionError{PROTOCOL_ERROR, "RST_STREAM on idle stream"}
+		}
+		if s != nil {
+			s.err = StreamError{f.StreamID, v.(*RstStream).Error, "RST_STREAM from the peer"}
+			con.closeStream(s)
+		}
+		return nil
+	case *WindowUpdate:
+		if state == StateIdle {
+			return ConnectionError{PROTOCOL_ERROR, "WINDOW_UPDATE on idle stream"}
+		}
+		return nil
+	case *Header:
+		return con.receiveHeaders(f, s, state, v.(*Header).Eos)
+	case *PushPromise:
+		return con.receivePushPromise(state, v.(*PushPromise).PromisedID)
+	}
+
+	// DATA (and the other frames carrying END_STREAM)
+	switch state {
+	case StateOpen, StateHalfClosedLocal:
+	case StateIdle, StateReservedLocal, StateReservedRemote:
+		return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("%s on %s stream", name, state)}
+	default:
+		return StreamError{f.StreamID, STREAM_CLOSED, fmt.Sprintf("%s on %s stream", name, state)}
+	}
+	if d, ok := v.(*Data); ok && d.Eos {
+		con.endStream(s, false)
+	}
+	return nil
+}
+
+// receiveHeaders handles HEADERS received on the stream. stateMu must be held.
+// the header block is already decoded (ParseFrame), so the dynamic table is
+// kept in sync even when the stream is refused or closed.
+func (con *Connection) receiveHeaders(f *Framer, s *Stream, state StreamState, eos bool) error {
+	id := f.StreamID
+	switch state {
+	case StateIdle:
+		// 5.1.1. Stream Identifiers
+		//  the peer opens its streams in increasing order
+		if con.local(id) {
+			return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("HEADERS opens stream %d of the other endpoint", id)}
+		}
+		con.lastPeerStreamID = id
+
+		// 6.8. the streams after GOAWAY are not processed
+		if con.goingAway {
+			if s != nil {
+				con.closeStream(s)
+			}
+			return StreamError{id, REFUSED_STREAM, "the connection is going away"}
+		}
+		// 5.1.2. Stream Concurrency
+		if max, ok := con.localSettings[MAX_CONCURRENT_STREAMS]; ok && con.activeStreams(false) >= max {
+			if s != nil {
+				con.closeStream(s)
+			}
+			return StreamError{id, REFUSED_STREAM, "SETTINGS_MAX_CONCURRENT_STREAMS is reached"}
+		}
+		if s == nil {
+			s = con.newStream(id)
+		}
+		s.state = StateOpen
+	case StateReservedRemote:
+		s.state = StateHalfClosedLocal
+	case StateOpen, StateHalfClosedLocal:
+		// informational responses or trailers
+	case StateClosed:
+		// 5.1.1. the peer can't open a stream lower than the streams opened
+		//  so far (the IDs it skipped are closed implicitly)
+		if !con.local(id) {
+			return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("HEADERS on stream %d lower than the last stream %d", id, con.lastPeerStreamID)}
+		}
+		return StreamError{id, STREAM_CLOSED, "HEADERS on closed stream"}
+	default:
+		return StreamError{id, STREAM_CLOSED, fmt.Sprintf("HEADERS on %s stream", state)}
+	}
+	if eos {
+		con.endStream(s, false)
+	}
+	return nil
+}
+
+// receivePushPromise reserves the promised stream (reserved (remote)).
+// stateMu must be held.
+func (con *Connection) receivePushPromise(state StreamState, promisedID uint32) error {
+	// 8.4. PUSH_PROMISE is sent on a stream opened by the client
+	if state != StateOpen && state != StateHalfClosedLocal {
+		return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("PUSH_PROMISE on %s stream", state)}
+	}
+	if con.local(promisedID) {
+		return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("promised stream %d of this endpoint", promisedID)}
+	}
+	p, pstate := con.lookup(promisedID)
+	if pstate != StateIdle {
+		return ConnectionError{PROTOCOL_ERROR, fmt.Sprintf("promised stream %d is %s", promisedID, pstate)}
+	}
+	con.lastPeerStreamID = promisedID
+	if p == nil {
+		p = con.newStream(promisedID)
+	}
+	p.state = StateReservedRemote
+	return nil
+}
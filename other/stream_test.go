@@ -0,0 +1,217 @@
+package minihttp2
+
+import (
+	"bytes"
+	"testing"
+	"./hpack"
+)
+
+func TestStreamLifecycle(t *testing.T) {
+	client, server := connPair(t)
+	serve(server, nil)
+	serve(client, nil)
+	request := []hpack.KeyValue{{Key: ":method", Value: "POST"}}
+
+	s := client.NewStream()
+	if s.State() != StateIdle {
+		t.Fatalf("Error: new stream want=idle, ans=%v", s.State())
+	}
+	WriteHeader(client, &Framer{StreamID: s.ID}, request, WithEndStream(false))
+	if s.State() != StateOpen {
+		t.Fatalf("Error: after HEADERS want=open, ans=%v", s.State())
+	}
+	waitUntil(t, func() bool { return server.Stream(s.ID) != nil })
+	ss := server.Stream(s.ID)
+	if ss.State() != StateOpen {
+		t.Fatalf("Error: server stream want=open, ans=%v", ss.State())
+	}
+
+	// request body with END_STREAM
+	WriteData(client, &Framer{StreamID: s.ID}, []byte("body"))
+	if s.State() != StateHalfClosedLocal {
+		t.Fatalf("Error: after END_STREAM want=half-closed (local), ans=%v", s.State())
+	}
+	waitUntil(t, func() bool { return ss.State() == StateHalfClosedRemote })
+	if err := WriteData(client, &Framer{StreamID: s.ID}, []byte("more")); err != ErrStreamClosed {
+		t.Fatalf("Error: DATA on half-closed (local) want=ErrStreamClosed, ans=%v", err)
+	}
+
+	// response closes the stream
+	WriteHeader(server, &Framer{StreamID: s.ID}, []hpack.KeyValue{{Key: ":status", Value: "200"}})
+	if ss.State() != StateClosed || server.Stream(s.ID) != nil {
+		t.Fatalf("Error: server stream want=closed, ans=%v", ss.State())
+	}
+	waitUntil(t, func() bool { return s.State() == StateClosed })
+	if err := WriteHeader(client, &Framer{StreamID: s.ID}, request); err != ErrStreamClosed {
+		t.Fatalf("Error: HEADERS on closed stream want=ErrStreamClosed, ans=%v", err)
+	}
+}
+
+func TestStreamReceiveValidation(t *testing.T) {
+	type frameCase struct {
+		name   string
+		id     uint32
+		v      interface{}
+		stream bool // StreamError (otherwise ConnectionError)
+		code   ErrorCode
+	}
+	server := NewServerConn(&bytes.Buffer{})
+	openStream(t, server, 1)
+	openStream(t, server, 5)
+	if err := server.receiveFrame(&Framer{StreamID: 5}, &Data{Eos: true}); err != nil {
+		t.Fatalf("Error: DATA %v", err)
+	}
+
+	for _, c := range []frameCase{
+		{"DATA idle", 7, &Data{}, false, PROTOCOL_ERROR},
+		{"RST_STREAM idle", 7, &RstStream{}, false, PROTOCOL_ERROR},
+		{"WINDOW_UPDATE idle", 7, &WindowUpdate{1}, false, PROTOCOL_ERROR},
+		{"HEADERS server stream", 2, &Header{}, false, PROTOCOL_ERROR},
+		{"HEADERS lower stream ID", 3, &Header{}, false, PROTOCOL_ERROR},
+		{"DATA half-closed (remote)", 5, &Data{}, true, STREAM_CLOSED},
+		{"HEADERS half-closed (remote)", 5, &Header{Eos: true}, true, STREAM_CLOSED},
+		{"PUSH_PROMISE to server", 1, &PushPromise{PromisedID: 2}, false, PROTOCOL_ERROR},
+	} {
+		err := server.receiveFrame(&Framer{StreamID: c.id}, c.v)
+		code, id, stream := ErrorCodeOf(err)
+		if err == nil || code != c.code || stream != c.stream || (stream && id != c.id) {
+			t.Fatalf("Error: %s want=%s (stream=%v), ans=%v", c.name, c.code, c.stream, err)
+		}
+	}
+
+	// PRIORITY in any state, RST_STREAM closes the stream
+	if err := server.receiveFrame(&Framer{StreamID: 9}, &Priority{}); err != nil {
+		t.Fatalf("Error: PRIORITY on idle stream %v", err)
+	}
+	if err := server.receiveFrame(&Framer{StreamID: 1}, &RstStream{CANCEL}); err != nil || server.Stream(1) != nil {
+		t.Fatalf("Error: RST_STREAM %v", err)
+	}
+	if err := server.receiveFrame(&Framer{StreamID: 1}, &WindowUpdate{1}); err != nil {
+		t.Fatalf("Error: WINDOW_UPDATE on closed stream %v", err)
+	}
+
+	// PUSH_PROMISE reserves the promised stream
+	client := NewClientConn(&bytes.Buffer{})
+	s := client.NewStream()
+	WriteHeader(client, &Framer{StreamID: s.ID}, []hpack.KeyValue{{Key: ":method", Value: "GET"}})
+	if err := client.receiveFrame(&Framer{StreamID: s.ID}, &PushPromise{PromisedID: 2}); err != nil {
+		t.Fatalf("Error: PUSH_PROMISE %v", err)
+	}
+	if p := client.Stream(2); p == nil || p.State() != StateReservedRemote {
+		t.Fatalf("Error: promised stream want=reserved (remote), ans=%v", p)
+	}
+	if err := client.receiveFrame(&Framer{StreamID: 2}, &Data{}); err == nil {
+		t.Fatalf("Error: DATA on reserved (remote) stream")
+	}
+	if err := client.receiveFrame(&Framer{StreamID: 2}, &Header{}); err != nil || client.Stream(2).State() != StateHalfClosedLocal {
+		t.Fatalf("Error: HEADERS on reserved (remote) stream %v", err)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	// received: the streams over the limit are refused
+	server := NewServerConn(&bytes.Buffer{})
+	server.localSettings[MAX_CONCURRENT_STREAMS] = 1
+	openStream(t, server, 1)
+	err := server.receiveFrame(&Framer{StreamID: 3}, &Header{})
+	if e, ok := err.(StreamError); !ok || e.Code != REFUSED_STREAM || e.StreamID != 3 {
+		t.Fatalf("Error: stream 3 want=REFUSED_STREAM, ans=%v", err)
+	}
+	server.receiveFrame(&Framer{StreamID: 1}, &RstStream{CANCEL})
+	openStream(t, server, 5)
+
+	// sent: the limit of the peer
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	client.remoteSettings[MAX_CONCURRENT_STREAMS] = 1
+	header := []hpack.KeyValue{{Key: ":method", Value: "GET"}}
+	if err := WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, header, WithEndStream(false)); err != nil {
+		t.Fatalf("Error: WriteHeader %v", err)
+	}
+	n := wire.Len()
+	err = WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, header)
+	if e, ok := err.(StreamError); !ok || e.Code != REFUSED_STREAM || wire.Len() != n {
+		t.Fatalf("Error: WriteHeader want=REFUSED_STREAM, ans=%v", err)
+	}
+}
+
+func TestHeadersOnRefusedStream(t *testing.T) {
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	server := NewServerConn(&bytes.Buffer{})
+	server.localSettings[MAX_CONCURRENT_STREAMS] = 1
+	header := []hpack.KeyValue{{Key: ":method", Value: "POST"}, {Key: "x-request", Value: "refused"}}
+
+	// the trailers of stream 3 are sent before RST_STREAM arrives,
+	// and the next block refers to the entries added by them
+	WriteHeader(client, &Framer{StreamID: 1}, header[:1], WithEndStream(false))
+	WriteHeader(client, &Framer{StreamID: 3}, header, WithEndStream(false))
+	WriteHeader(client, &Framer{StreamID: 3}, []hpack.KeyValue{{Key: "x-trailer", Value: "done"}})
+	WriteHeader(client, &Framer{StreamID: 1}, []hpack.KeyValue{{Key: "x-request", Value: "refused"}, {Key: "x-trailer", Value: "done"}})
+
+	frames, payloads := splitFrames(t, wire.Bytes())
+	for i, want := range []ErrorCode{NO_ERROR, REFUSED_STREAM, NO_ERROR, NO_ERROR} {
+		v, err := server.ParseFrame(&frames[i], payloads[i])
+		if err != nil {
+			t.Fatalf("Error: ParseFrame %d %v", i, err)
+		}
+		err = server.handleFrame(&frames[i], v, nil)
+		if code, id, _ := ErrorCodeOf(err); err != nil && code == want {
+			// as Serve does
+			WriteRstStream(server, &Framer{StreamID: id}, code)
+		} else if err != nil || want != NO_ERROR {
+			t.Fatalf("Error: frame %d want=%s, ans=%v", i, want, err)
+		}
+		if h := v.(*Header); i == 3 && (len(h.Header) != 2 || h.Header[1].Value != "done") {
+			t.Fatalf("Error: header block after the refused stream %v", h.Header)
+		}
+	}
+	if s := server.Stream(1); s == nil || s.State() != StateHalfClosedRemote {
+		t.Fatalf("Error: stream 1 want=half-closed (remote), ans=%v", s)
+	}
+}
+
+func TestWriteHeaderEncodeError(t *testing.T) {
+	// the stream state isn't changed when the header block can't be encoded
+	wire := &bytes.Buffer{}
+	client := NewClientConn(wire)
+	client.remoteSettings[MAX_CONCURRENT_STREAMS] = 1
+	header := []hpack.KeyValue{{Key: ":method", Value: "GET"}, {Key: "x-request", Value: "1"}}
+	policy := client.sendHeaderCache.IndexPolicy
+	client.sendHeaderCache.IndexPolicy = func(kv hpack.KeyValue) hpack.Indexing { return 99 }
+
+	s := client.NewStream()
+	if err := WriteHeader(client, &Framer{StreamID: s.ID}, header); err == nil {
+		t.Fatalf("Error: WriteHeader with unknown indexing")
+	}
+	if s.State() != StateIdle || wire.Len() != 0 {
+		t.Fatalf("Error: stream want=idle and no frame, ans=%s %d", s.State(), wire.Len())
+	}
+
+	// the failed stream isn't counted against MAX_CONCURRENT_STREAMS
+	client.sendHeaderCache.IndexPolicy = policy
+	if err := WriteHeader(client, &Framer{StreamID: client.NewStream().ID}, header, WithEndStream(false)); err != nil {
+		t.Fatalf("Error: WriteHeader %v", err)
+	}
+}
+
+func TestResetStreamsLimit(t *testing.T) {
+	server := NewServerConn(&bytes.Buffer{})
+	last := uint32(2*MAX_RESET_STREAMS + 9)
+	for id := uint32(1); id <= last; id += 2 {
+		openStream(t, server, id)
+		WriteRstStream(server, &Framer{StreamID: id}, CANCEL)
+	}
+	if len(server.resetStreams) != MAX_RESET_STREAMS {
+		t.Fatalf("Error: reset streams want=%d, ans=%d", MAX_RESET_STREAMS, len(server.resetStreams))
+	}
+
+	// the frames on the latest ones are ignored, the oldest ones are forgotten
+	if err := server.receiveFrame(&Framer{StreamID: last}, &Data{}); err != errStreamReset {
+		t.Fatalf("Error: DATA on reset stream %d %v", last, err)
+	}
+	err := server.receiveFrame(&Framer{StreamID: 1}, &Data{})
+	if e, ok := err.(StreamError); !ok || e.Code != STREAM_CLOSED {
+		t.Fatalf("Error: DATA on stream 1 want=STREAM_CLOSED, ans=%v", err)
+	}
+}
@@ -0,0 +1,418 @@
+package qpack
+
+import (
+	"io"
+
+	hpack "github.com/rung/minihpack"
+)
+
+// Decoder decodes the field sections of request streams and processes the encoder stream.
+// decoder instructions (Section Acknowledgment, Stream Cancellation, Insert Count Increment)
+// are written to decoderStream.
+type Decoder struct {
+	table             dynamicTable
+	maxCapacity       uint64 // SETTINGS_QPACK_MAX_TABLE_CAPACITY (sent by us)
+	maxBlockedStreams uint64 // SETTINGS_QPACK_BLOCKED_STREAMS (sent by us)
+	decoderStream     io.Writer
+	encoderStream     []byte // incomplete encoder instruction
+	known             uint64 // insert count which the encoder knows that we received
+	blocked           []blockedSection
+
+	// Unblocked is called when a blocked field section has been decoded.
+	Unblocked func(streamID uint64, fields []hpack.KeyValue, err error)
+}
+
+type blockedSection struct {
+	streamID uint64
+	ric      uint64
+	base     uint64
+	lines    []byte
+}
+
+func NewDecoder(decoderStream io.Writer, maxCapacity uint64, maxBlockedStreams uint64) *Decoder {
+	return &Decoder{
+		maxCapacity:       maxCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+		decoderStream:     decoderStream,
+	}
+}
+
+// InsertCount returns the number of entries inserted into the dynamic table.
+func (d *Decoder) InsertCount() uint64 {
+	return d.table.insertCount()
+}
+
+// HandleEncoderStream processes the bytes received on the encoder stream.
+// instructions may be split at any point, the rest is kept until the next call.
+// blocked field sections which became decodable are passed to Unblocked.
+func (d *Decoder) HandleEncoderStream(p []byte) error {
+	b := append(d.encoderStream, p...)
+	for len(b) > 0 {
+		rest, err := d.parseEncoderInstruction(b)
+		if err == errNeedMore {
+			break
+		}
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		if err != nil {
+			return Error{QPACK_ENCODER_STREAM_ERROR, err.Error()}
+		}
+		b = rest
+	}
+	d.encoderStream = append([]byte{}, b...)
+
+	return d.unblock()
+}
+
+// 4.3. Encoder Instructions
+func (d *Decoder) parseEncoderInstruction(b []byte) ([]byte, error) {
+	switch {
+	case b[0]&0x80 == 0x80:
+		// Insert with Name Reference
+		//   0   1   2   3   4   5   6   7
+		// +---+---+---+---+---+---+---+---+
+		// | 1 | T |    Name Index (6+)    |
+		// +---+---+-----------------------+
+		// | H |     Value Length (7+)     |
+		// +---+---------------------------+
+		// |  Value String (Length bytes)  |
+		// +-------------------------------+
+		static := b[0]&0x40 == 0x40
+		i, rb, err := readInt(b, 6)
+		if err != nil {
+			return nil, err
+		}
+		value, rb, err := readString(rb, 7)
+		if err != nil {
+			return nil, err
+		}
+		var name hpack.KeyValue
+		if static {
+			if i >= uint64(len(staticTable)) {
+				return nil, Error{QPACK_ENCODER_STREAM_ERROR, "invalid static index"}
+			}
+			name = staticTable[i]
+		} else {
+			// relative index: insert count - 1 - i
+			if i >= d.table.insertCount() {
+				return nil, Error{QPACK_ENCODER_STREAM_ERROR, "invalid relative index"}
+			}
+			kv, ok := d.table.get(d.table.insertCount() - 1 - i)
+			if !ok {
+				return nil, Error{QPACK_ENCODER_STREAM_ERROR, "evicted entry is referenced"}
+			}
+			name = kv
+		}
+		return rb, d.table.insert(hpack.KeyValue{Key: name.Key, Value: value})
+
+	case b[0]&0xc0 == 0x40:
+		// Insert with Literal Name
+		//   0   1   2   3   4   5   6   7
+		// +---+---+---+---+---+---+---+---+
+		// | 0 | 1 | H | Name Length (5+)  |
+		// +---+---+---+-------------------+
+		// |  Name String (Length bytes)   |
+		// +---+---------------------------+
+		// | H |     Value Length (7+)     |
+		// +---+---------------------------+
+		// |  Value String (Length bytes)  |
+		// +-------------------------------+
+		name, rb, err := readString(b, 5)
+		if err != nil {
+			return nil, err
+		}
+		value, rb, err := readString(rb, 7)
+		if err != nil {
+			return nil, err
+		}
+		return rb, d.table.insert(hpack.KeyValue{Key: name, Value: value})
+
+	case b[0]&0xe0 == 0x20:
+		// Set Dynamic Table Capacity
+		//   0   1   2   3   4   5   6   7
+		// +---+---+---+---+---+---+---+---+
+		// | 0 | 0 | 1 |   Capacity (5+)   |
+		// +---+---+---+-------------------+
+		c, rb, err := readInt(b, 5)
+		if err != nil {
+			return nil, err
+		}
+		if c > d.maxCapacity {
+			return nil, Error{QPACK_ENCODER_STREAM_ERROR, "capacity exceeds the maximum"}
+		}
+		d.table.setCapacity(c)
+		return rb, nil
+
+	default:
+		// Duplicate
+		//   0   1   2   3   4   5   6   7
+		// +---+---+---+---+---+---+---+---+
+		// | 0 | 0 | 0 |    Index (5+)     |
+		// +---+---+---+-------------------+
+		i, rb, err := readInt(b, 5)
+		if err != nil {
+			return nil, err
+		}
+		if i >= d.table.insertCount() {
+			return nil, Error{QPACK_ENCODER_STREAM_ERROR, "invalid relative index"}
+		}
+		kv, ok := d.table.get(d.table.insertCount() - 1 - i)
+		if !ok {
+			return nil, Error{QPACK_ENCODER_STREAM_ERROR, "evicted entry is referenced"}
+		}
+		return rb, d.table.insert(kv)
+	}
+}
+
+// Decode decodes the field section of streamID.
+// when the section refers to entries which have not arrived yet, it is kept and
+// ErrBlocked is returned. The fields are passed to Unblocked later.
+func (d *Decoder) Decode(streamID uint64, data []byte) ([]hpack.KeyValue, error) {
+	ric, base, lines, err := d.parsePrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	if ric > d.table.insertCount() {
+		// 2.1.2. the limit is the number of streams (a stream may have several sections)
+		if !d.isBlocked(streamID) && d.blockedStreams() >= d.maxBlockedStreams {
+			return nil, Error{QPACK_DECOMPRESSION_FAILED, "too many blocked streams"}
+		}
+		d.blocked = append(d.blocked, blockedSection{streamID, ric, base, append([]byte{}, lines...)})
+		return nil, ErrBlocked
+	}
+	return d.decodeLines(streamID, ric, base, lines)
+}
+
+// CancelStream discards the blocked section of streamID and tells the encoder (4.4.2).
+func (d *Decoder) CancelStream(streamID uint64) error {
+	blocked := []blockedSection{}
+	for _, s := range d.blocked {
+		if s.streamID != streamID {
+			blocked = append(blocked, s)
+		}
+	}
+	d.blocked = blocked
+	if d.maxCapacity == 0 {
+		return nil
+	}
+	// Stream Cancellation
+	//   0   1   2   3   4   5   6   7
+	// +---+---+---+---+---+---+---+---+
+	// | 0 | 1 |     Stream ID (6+)    |
+	// +---+---+-----------------------+
+	return d.writeDecoderStream(appendInt(nil, 0x40, 6, streamID))
+}
+
+// AcknowledgeInserts sends Insert Count Increment for the entries which the
+// encoder doesn't know that we received (4.4.3).
+func (d *Decoder) AcknowledgeInserts() error {
+	ic := d.table.insertCount()
+	if ic <= d.known {
+		return nil
+	}
+	// Insert Count Increment
+	//   0   1   2   3   4   5   6   7
+	// +---+---+---+---+---+---+---+---+
+	// | 0 | 0 |     Increment (6+)    |
+	// +---+---+-----------------------+
+	err := d.writeDecoderStream(appendInt(nil, 0x00, 6, ic-d.known))
+	d.known = ic
+	return err
+}
+
+// number of streams which have blocked field sections
+func (d *Decoder) blockedStreams() uint64 {
+	streams := map[uint64]bool{}
+	for _, s := range d.blocked {
+		streams[s.streamID] = true
+	}
+	return uint64(len(streams))
+}
+
+func (d *Decoder) isBlocked(streamID uint64) bool {
+	for _, s := range d.blocked {
+		if s.streamID == streamID {
+			return true
+		}
+	}
+	return false
+}
+
+// unblock decodes the blocked field sections which became decodable.
+// they are removed from blocked before decoding, so that each of them is passed
+// to Unblocked once. the first error is returned after all of them are decoded.
+func (d *Decoder) unblock() error {
+	blocked := []blockedSection{}
+	ready := []blockedSection{}
+	for _, s := range d.blocked {
+		if s.ric > d.table.insertCount() {
+			blocked = append(blocked, s)
+		} else {
+			ready = append(ready, s)
+		}
+	}
+	d.blocked = blocked
+
+	var first error
+	for _, s := range ready {
+		fields, err := d.decodeLines(s.streamID, s.ric, s.base, s.lines)
+		if d.Unblocked != nil {
+			d.Unblocked(s.streamID, fields, err)
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// 4.5.1. Encoded Field Section Prefix
+//   0   1   2   3   4   5   6   7
+// +---+---+---+---+---+---+---+---+
+// |   Required Insert Count (8+)  |
+// +---+---------------------------+
+// | S |      Delta Base (7+)      |
+// +---+---------------------------+
+// |      Encoded Field Lines    ...
+// +-------------------------------+
+func (d *Decoder) parsePrefix(data []byte) (ric uint64, base uint64, lines []byte, err error) {
+	enc, rb, err := readInt(data, 8)
+	if err != nil {
+		return 0, 0, nil, Error{QPACK_DECOMPRESSION_FAILED, "truncated prefix"}
+	}
+	ric, err = decodeInsertCount(enc, d.maxCapacity, d.table.insertCount())
+	if err != nil {
+		return 0, 0, nil, Error{QPACK_DECOMPRESSION_FAILED, err.Error()}
+	}
+	if len(rb) == 0 {
+		return 0, 0, nil, Error{QPACK_DECOMPRESSION_FAILED, "truncated prefix"}
+	}
+	sign := rb[0]&0x80 == 0x80
+	delta, rb, err := readInt(rb, 7)
+	if err != nil {
+		return 0, 0, nil, Error{QPACK_DECOMPRESSION_FAILED, "truncated prefix"}
+	}
+	if sign {
+		if delta+1 > ric {
+			return 0, 0, nil, Error{QPACK_DECOMPRESSION_FAILED, "invalid base"}
+		}
+		base = ric - delta - 1
+	} else {
+		base = ric + delta
+	}
+	return ric, base, rb, nil
+}
+
+// 4.5.2 - 4.5.6 Field Line Representations
+func (d *Decoder) decodeLines(streamID uint64, ric uint64, base uint64, b []byte) ([]hpack.KeyValue, error) {
+	// dynamic references must be less than the required insert count
+	dynamic := func(abs uint64) (hpack.KeyValue, error) {
+		if abs >= ric {
+			return hpack.KeyValue{}, Error{QPACK_DECOMPRESSION_FAILED, "reference beyond the required insert count"}
+		}
+		kv, ok := d.table.get(abs)
+		if !ok {
+			return hpack.KeyValue{}, Error{QPACK_DECOMPRESSION_FAILED, "evicted entry is referenced"}
+		}
+		return kv, nil
+	}
+	relative := func(i uint64) (hpack.KeyValue, error) {
+		if i >= base {
+			return hpack.KeyValue{}, Error{QPACK_DECOMPRESSION_FAILED, "invalid relative index"}
+		}
+		return dynamic(base - 1 - i)
+	}
+	static := func(i uint64) (hpack.KeyValue, error) {
+		if i >= uint64(len(staticTable)) {
+			return hpack.KeyValue{}, Error{QPACK_DECOMPRESSION_FAILED, "invalid static index"}
+		}
+		return staticTable[i], nil
+	}
+
+	fields := []hpack.KeyValue{}
+	for len(b) > 0 {
+		var kv hpack.KeyValue
+		var i uint64
+		var err error
+		switch {
+		case b[0]&0x80 == 0x80:
+			// 4.5.2. Indexed Field Line
+			// | 1 | T |      Index (6+)       |
+			isStatic := b[0]&0x40 == 0x40
+			i, b, err = readInt(b, 6)
+			if err == nil && isStatic {
+				kv, err = static(i)
+			} else if err == nil {
+				kv, err = relative(i)
+			}
+		case b[0]&0xc0 == 0x40:
+			// 4.5.4. Literal Field Line with Name Reference
+			// | 0 | 1 | N | T |Name Index (4+)|
+			// | H |     Value Length (7+)     |
+			isStatic := b[0]&0x10 == 0x10
+			i, b, err = readInt(b, 4)
+			if err == nil && isStatic {
+				kv, err = static(i)
+			} else if err == nil {
+				kv, err = relative(i)
+			}
+			if err == nil {
+				kv.Value, b, err = readString(b, 7)
+			}
+		case b[0]&0xe0 == 0x20:
+			// 4.5.6. Literal Field Line with Literal Name
+			// | 0 | 0 | 1 | N | H |NameLen(3+)|
+			// | H |     Value Length (7+)     |
+			kv.Key, b, err = readString(b, 3)
+			if err == nil {
+				kv.Value, b, err = readString(b, 7)
+			}
+		case b[0]&0xf0 == 0x10:
+			// 4.5.3. Indexed Field Line with Post-Base Index
+			// | 0 | 0 | 0 | 1 |  Index (4+)   |
+			i, b, err = readInt(b, 4)
+			if err == nil {
+				kv, err = dynamic(base + i)
+			}
+		default:
+			// 4.5.5. Literal Field Line with Post-Base Name Reference
+			// | 0 | 0 | 0 | 0 | N |NameIdx(3+)|
+			// | H |     Value Length (7+)     |
+			i, b, err = readInt(b, 3)
+			if err == nil {
+				kv, err = dynamic(base + i)
+			}
+			if err == nil {
+				kv.Value, b, err = readString(b, 7)
+			}
+		}
+		if err != nil {
+			if _, ok := err.(Error); ok {
+				return nil, err
+			}
+			return nil, Error{QPACK_DECOMPRESSION_FAILED, err.Error()}
+		}
+		fields = append(fields, kv)
+	}
+
+	// 4.4.1. Section Acknowledgment
+	//   0   1   2   3   4   5   6   7
+	// +---+---+---+---+---+---+---+---+
+	// | 1 |      Stream ID (7+)       |
+	// +---+---------------------------+
+	if ric > 0 {
+		if ric > d.known {
+			d.known = ric
+		}
+		if err := d.writeDecoderStream(appendInt(nil, 0x80, 7, streamID)); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+func (d *Decoder) writeDecoderStream(b []byte) error {
+	_, err := d.decoderStream.Write(b)
+	return err
+}
@@ -0,0 +1,334 @@
+package qpack
+
+import (
+	"errors"
+	"io"
+
+	hpack "github.com/rung/minihpack"
+)
+
+// Encoder encodes field sections and writes encoder instructions to encoderStream.
+// decoder instructions from the peer are given to HandleDecoderStream.
+//
+// Strategy
+//  every field which fits in the table is inserted, and it is referenced from
+//  the field section when the stream is allowed to be blocked
+//  (SETTINGS_QPACK_BLOCKED_STREAMS) or when the decoder has acknowledged it.
+//  entries referenced by unacknowledged sections are never evicted.
+type Encoder struct {
+	table             dynamicTable
+	maxCapacity       uint64 // SETTINGS_QPACK_MAX_TABLE_CAPACITY (sent by the peer)
+	maxBlockedStreams uint64 // SETTINGS_QPACK_BLOCKED_STREAMS (sent by the peer)
+	encoderStream     io.Writer
+	decoderStream     []byte // incomplete decoder instruction
+	known             uint64 // Known Received Count
+	sections          map[uint64][]section
+}
+
+// unacknowledged field section
+type section struct {
+	ric    uint64 // Required Insert Count
+	minRef uint64 // smallest referenced absolute index
+}
+
+func NewEncoder(encoderStream io.Writer, maxCapacity uint64, maxBlockedStreams uint64) *Encoder {
+	return &Encoder{
+		maxCapacity:       maxCapacity,
+		maxBlockedStreams: maxBlockedStreams,
+		encoderStream:     encoderStream,
+		sections:          map[uint64][]section{},
+	}
+}
+
+// InsertCount returns the number of entries inserted into the dynamic table.
+func (e *Encoder) InsertCount() uint64 {
+	return e.table.insertCount()
+}
+
+// KnownReceivedCount returns the number of entries acknowledged by the decoder.
+func (e *Encoder) KnownReceivedCount() uint64 {
+	return e.known
+}
+
+// SetCapacity changes the dynamic table capacity (Set Dynamic Table Capacity).
+func (e *Encoder) SetCapacity(capacity uint64) error {
+	if capacity > e.maxCapacity {
+		return errors.New("SetCapacity: capacity exceeds SETTINGS_QPACK_MAX_TABLE_CAPACITY")
+	}
+	// entries referenced by unacknowledged sections can't be evicted
+	n, size := 0, e.table.size
+	for size > capacity {
+		size -= entrySize(e.table.entries[n])
+		n++
+	}
+	if e.table.dropped+uint64(n) > e.minReference() {
+		return errors.New("SetCapacity: referenced entries would be evicted")
+	}
+
+	//   0   1   2   3   4   5   6   7
+	// +---+---+---+---+---+---+---+---+
+	// | 0 | 0 | 1 |   Capacity (5+)   |
+	// +---+---+---+-------------------+
+	if err := e.writeEncoderStream(appendInt(nil, 0x20, 5, capacity)); err != nil {
+		return err
+	}
+	e.table.setCapacity(capacity)
+	return nil
+}
+
+// the smallest absolute index referenced by unacknowledged sections
+func (e *Encoder) minReference() uint64 {
+	min := e.table.insertCount()
+	for _, ss := range e.sections {
+		for _, s := range ss {
+			if s.minRef < min {
+				min = s.minRef
+			}
+		}
+	}
+	return min
+}
+
+// number of streams which may be blocked by the decoder
+func (e *Encoder) blockedStreams() uint64 {
+	n := uint64(0)
+	for id := range e.sections {
+		if e.isBlocking(id) {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *Encoder) isBlocking(streamID uint64) bool {
+	for _, s := range e.sections[streamID] {
+		if s.ric > e.known {
+			return true
+		}
+	}
+	return false
+}
+
+// field line kinds
+const (
+	lineIndexedStatic = iota
+	lineIndexedDynamic
+	lineLiteralStaticName
+	lineLiteralDynamicName
+	lineLiteralName
+)
+
+type fieldLine struct {
+	kind  int
+	index uint64 // static index or absolute index
+	kv    hpack.KeyValue
+}
+
+// Encode encodes the field section of streamID.
+// new entries are written to the encoder stream before the section is returned,
+// so the encoder stream has to be sent first.
+func (e *Encoder) Encode(streamID uint64, fields []hpack.KeyValue) ([]byte, error) {
+	blocking := e.isBlocking(streamID) || e.blockedStreams() < e.maxBlockedStreams
+
+	var ric uint64
+	minRef := e.table.insertCount()
+	ref := func(abs uint64) {
+		if abs+1 > ric {
+			ric = abs + 1
+		}
+		if abs < minRef {
+			minRef = abs
+		}
+	}
+	usable := func(abs uint64) bool {
+		return abs < e.known || blocking
+	}
+
+	lines := []fieldLine{}
+	for _, kv := range fields {
+		si, sfull, sok := searchStaticTable(kv)
+		if sok && sfull {
+			lines = append(lines, fieldLine{lineIndexedStatic, si, kv})
+			continue
+		}
+		da, dfull, dok := e.table.search(kv)
+		if dok && dfull && usable(da) {
+			ref(da)
+			lines = append(lines, fieldLine{lineIndexedDynamic, da, kv})
+			continue
+		}
+
+		abs, inserted, err := e.insert(kv, minRef)
+		if err != nil {
+			return nil, err
+		}
+		if inserted && blocking {
+			ref(abs)
+			lines = append(lines, fieldLine{lineIndexedDynamic, abs, kv})
+			continue
+		}
+
+		// the insertion may have evicted the name
+		da, _, dok = e.table.search(kv)
+		if sok {
+			lines = append(lines, fieldLine{lineLiteralStaticName, si, kv})
+		} else if dok && usable(da) {
+			ref(da)
+			lines = append(lines, fieldLine{lineLiteralDynamicName, da, kv})
+		} else {
+			lines = append(lines, fieldLine{lineLiteralName, 0, kv})
+		}
+	}
+
+	// 4.5.1. Encoded Field Section Prefix
+	//  Base is the insert count, so every reference is a relative index (Sign = 0)
+	//   0   1   2   3   4   5   6   7
+	// +---+---+---+---+---+---+---+---+
+	// |   Required Insert Count (8+)  |
+	// +---+---------------------------+
+	// | S |      Delta Base (7+)      |
+	// +---+---------------------------+
+	base := uint64(0)
+	if ric > 0 {
+		base = e.table.insertCount()
+	}
+	b := appendInt(nil, 0, 8, encodeInsertCount(ric, e.maxCapacity))
+	b = appendInt(b, 0, 7, base-ric)
+
+	for _, l := range lines {
+		switch l.kind {
+		case lineIndexedStatic:
+			// | 1 | T |      Index (6+)       |
+			b = appendInt(b, 0xc0, 6, l.index)
+		case lineIndexedDynamic:
+			b = appendInt(b, 0x80, 6, base-1-l.index)
+		case lineLiteralStaticName:
+			// | 0 | 1 | N | T |Name Index (4+)|
+			b = appendInt(b, 0x50, 4, l.index)
+			b = appendString(b, 0, 7, l.kv.Value)
+		case lineLiteralDynamicName:
+			b = appendInt(b, 0x40, 4, base-1-l.index)
+			b = appendString(b, 0, 7, l.kv.Value)
+		case lineLiteralName:
+			// | 0 | 0 | 1 | N | H |NameLen(3+)|
+			b = appendString(b, 0x20, 3, l.kv.Key)
+			b = appendString(b, 0, 7, l.kv.Value)
+		}
+	}
+
+	if ric > 0 {
+		e.sections[streamID] = append(e.sections[streamID], section{ric, minRef})
+	}
+	return b, nil
+}
+
+// insert adds kv to the dynamic table when it fits without evicting
+// referenced entries (limit: smallest absolute index referenced by the current section).
+func (e *Encoder) insert(kv hpack.KeyValue, limit uint64) (uint64, bool, error) {
+	n, ok := e.table.evictable(entrySize(kv))
+	if !ok {
+		return 0, false, nil
+	}
+	if min := e.minReference(); min < limit {
+		limit = min
+	}
+	if e.table.dropped+uint64(n) > limit {
+		return 0, false, nil
+	}
+
+	// 4.3.2 / 4.3.3 Insert with Name Reference / Insert with Literal Name
+	var b []byte
+	if si, _, sok := searchStaticTable(kv); sok {
+		// | 1 | T |    Name Index (6+)    |
+		b = appendInt(nil, 0xc0, 6, si)
+	} else if da, _, dok := e.table.search(kv); dok {
+		// relative index: insert count - 1 - absolute index
+		b = appendInt(nil, 0x80, 6, e.table.insertCount()-1-da)
+	} else {
+		// | 0 | 1 | H | Name Length (5+)  |
+		b = appendString(nil, 0x40, 5, kv.Key)
+	}
+	b = appendString(b, 0, 7, kv.Value)
+	if err := e.writeEncoderStream(b); err != nil {
+		return 0, false, err
+	}
+	if err := e.table.insert(kv); err != nil {
+		return 0, false, err
+	}
+	return e.table.insertCount() - 1, true, nil
+}
+
+// HandleDecoderStream processes the bytes received on the decoder stream.
+// instructions may be split at any point, the rest is kept until the next call.
+func (e *Encoder) HandleDecoderStream(p []byte) error {
+	b := append(e.decoderStream, p...)
+	for len(b) > 0 {
+		rest, err := e.parseDecoderInstruction(b)
+		if err == errNeedMore {
+			break
+		}
+		if _, ok := err.(Error); ok {
+			return err
+		}
+		if err != nil {
+			return Error{QPACK_DECODER_STREAM_ERROR, err.Error()}
+		}
+		b = rest
+	}
+	e.decoderStream = append([]byte{}, b...)
+	return nil
+}
+
+// 4.4. Decoder Instructions
+func (e *Encoder) parseDecoderInstruction(b []byte) ([]byte, error) {
+	switch {
+	case b[0]&0x80 == 0x80:
+		// Section Acknowledgment
+		// | 1 |      Stream ID (7+)       |
+		id, rb, err := readInt(b, 7)
+		if err != nil {
+			return nil, err
+		}
+		ss := e.sections[id]
+		if len(ss) == 0 {
+			return nil, Error{QPACK_DECODER_STREAM_ERROR, "no section to acknowledge"}
+		}
+		if ss[0].ric > e.known {
+			e.known = ss[0].ric
+		}
+		if len(ss) == 1 {
+			delete(e.sections, id)
+		} else {
+			e.sections[id] = ss[1:]
+		}
+		return rb, nil
+
+	case b[0]&0xc0 == 0x40:
+		// Stream Cancellation
+		// | 0 | 1 |     Stream ID (6+)    |
+		id, rb, err := readInt(b, 6)
+		if err != nil {
+			return nil, err
+		}
+		delete(e.sections, id)
+		return rb, nil
+
+	default:
+		// Insert Count Increment
+		// | 0 | 0 |     Increment (6+)    |
+		n, rb, err := readInt(b, 6)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || e.known+n > e.table.insertCount() {
+			return nil, Error{QPACK_DECODER_STREAM_ERROR, "invalid increment"}
+		}
+		e.known += n
+		return rb, nil
+	}
+}
+
+func (e *Encoder) writeEncoderStream(b []byte) error {
+	_, err := e.encoderStream.Write(b)
+	return err
+}
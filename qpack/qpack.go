@@ -0,0 +1,166 @@
+// Package qpack implements QPACK (RFC 9204), the field compression of HTTP/3.
+//
+// The huffman code and the KeyValue type are shared with the hpack package.
+// Encoder and Decoder don't own any stream, the encoder stream and the decoder
+// stream are plain byte slices / io.Writers so that they can be tested in memory.
+package qpack
+
+import (
+	"errors"
+	"fmt"
+
+	hpack "github.com/rung/minihpack"
+)
+
+// QPACK Error Codes (6. Error Handling)
+type ErrorCode uint64
+
+const (
+	QPACK_DECOMPRESSION_FAILED ErrorCode = 0x200
+	QPACK_ENCODER_STREAM_ERROR ErrorCode = 0x201
+	QPACK_DECODER_STREAM_ERROR ErrorCode = 0x202
+)
+
+var errorName = map[ErrorCode]string{
+	QPACK_DECOMPRESSION_FAILED: "QPACK_DECOMPRESSION_FAILED",
+	QPACK_ENCODER_STREAM_ERROR: "QPACK_ENCODER_STREAM_ERROR",
+	QPACK_DECODER_STREAM_ERROR: "QPACK_DECODER_STREAM_ERROR",
+}
+
+func (c ErrorCode) String() string {
+	if n, ok := errorName[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown error 0x%x", uint64(c))
+}
+
+// Error is a connection error of HTTP/3 caused by QPACK.
+type Error struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("qpack: %s: %s", e.Code, e.Reason)
+}
+
+// ErrBlocked is returned by Decoder.Decode when the field section refers to
+// entries which have not arrived on the encoder stream yet.
+var ErrBlocked = errors.New("qpack: field section is blocked")
+
+// errNeedMore means that the instruction is not complete yet (more bytes are needed).
+var errNeedMore = errors.New("qpack: need more bytes")
+
+// 4.1.1. Prefixed Integers (same as RFC 7541 5.1)
+//  first: upper bits of the first byte (flags)
+//  n: prefix length
+func appendInt(dst []byte, first byte, n uint8, v uint64) []byte {
+	max := uint64(1)<<n - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	v -= max
+	for v >= 128 {
+		dst = append(dst, byte(v&127)|128)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// readInt reads a prefixed integer.
+// errNeedMore is returned when b ends in the middle of the integer.
+func readInt(b []byte, n uint8) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errNeedMore
+	}
+	max := uint64(1)<<n - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, b[1:], nil
+	}
+	m := uint(0)
+	for i := 1; i < len(b); i++ {
+		v += uint64(b[i]&127) << m
+		if b[i]&128 == 0 {
+			return v, b[i+1:], nil
+		}
+		m += 7
+		if m > 62 {
+			return 0, nil, errors.New("integer overflow")
+		}
+	}
+	return 0, nil, errNeedMore
+}
+
+// 4.1.2. String Literals
+//  H flag is the bit just above the n bit length prefix.
+//  huffman coding is used when it is shorter.
+func appendString(dst []byte, first byte, n uint8, str string) []byte {
+	if l := hpack.HuffmanEncodedLen(str); l < len(str) {
+		dst = appendInt(dst, first|1<<n, n, uint64(l))
+		return hpack.HuffmanEncode(dst, str)
+	}
+	dst = appendInt(dst, first, n, uint64(len(str)))
+	return append(dst, str...)
+}
+
+func readString(b []byte, n uint8) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, errNeedMore
+	}
+	huf := b[0]&(1<<n) != 0
+	l, rb, err := readInt(b, n)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(rb)) < l {
+		return "", nil, errNeedMore
+	}
+	if huf {
+		s, err := hpack.HuffmanDecode(rb[:l])
+		if err != nil {
+			return "", nil, err
+		}
+		return s, rb[l:], nil
+	}
+	return string(rb[:l]), rb[l:], nil
+}
+
+// 3.2.1. Dynamic Table Size
+func entrySize(kv hpack.KeyValue) uint64 {
+	return uint64(len(kv.Key) + len(kv.Value) + 32)
+}
+
+// 4.5.1.1. Required Insert Count
+func encodeInsertCount(ric uint64, maxCapacity uint64) uint64 {
+	if ric == 0 {
+		return 0
+	}
+	maxEntries := maxCapacity / 32
+	return ric%(2*maxEntries) + 1
+}
+
+func decodeInsertCount(enc uint64, maxCapacity uint64, totalInserts uint64) (uint64, error) {
+	if enc == 0 {
+		return 0, nil
+	}
+	maxEntries := maxCapacity / 32
+	fullRange := 2 * maxEntries
+	if enc > fullRange {
+		return 0, errors.New("encoded insert count exceeds the full range")
+	}
+	maxValue := totalInserts + maxEntries
+	maxWrapped := maxValue / fullRange * fullRange
+	ric := maxWrapped + enc - 1
+	if ric > maxValue {
+		if ric <= fullRange {
+			return 0, errors.New("invalid required insert count")
+		}
+		ric -= fullRange
+	}
+	if ric == 0 {
+		return 0, errors.New("invalid required insert count")
+	}
+	return ric, nil
+}
@@ -0,0 +1,355 @@
+package qpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	hpack "github.com/rung/minihpack"
+)
+
+func wire(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("Error wire: %v", err)
+	}
+	return b
+}
+
+func TestPrefixedInt(t *testing.T) {
+	for _, n := range []uint8{3, 4, 5, 6, 7, 8} {
+		for _, v := range []uint64{0, 1, 6, 7, 30, 31, 127, 128, 255, 1337, 1 << 40} {
+			b := appendInt(nil, 0, n, v)
+			ans, rest, err := readInt(b, n)
+			if err != nil || ans != v || len(rest) != 0 {
+				t.Fatalf("Error readInt n=%d: want=%d, ans=%d %v", n, v, ans, err)
+			}
+			if len(b) > 1 {
+				if _, _, err := readInt(b[:len(b)-1], n); err != errNeedMore {
+					t.Fatalf("Error readInt n=%d v=%d: want=errNeedMore, ans=%v", n, v, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRequiredInsertCount(t *testing.T) {
+	// MaxEntries = 3, FullRange = 6
+	maxCapacity := uint64(100)
+	for ric := uint64(1); ric < 30; ric++ {
+		for total := ric; total+3 > ric && total < ric+3; total-- {
+			enc := encodeInsertCount(ric, maxCapacity)
+			ans, err := decodeInsertCount(enc, maxCapacity, total)
+			if err != nil || ans != ric {
+				t.Fatalf("Error decodeInsertCount total=%d: want=%d, ans=%d %v", total, ric, ans, err)
+			}
+			if total == 0 {
+				break
+			}
+		}
+	}
+	if _, err := decodeInsertCount(7, maxCapacity, 0); err == nil {
+		t.Fatalf("Error decodeInsertCount: want error for encoded value > FullRange")
+	}
+}
+
+func checkTable(t *testing.T, name string, table dynamicTable, want []hpack.KeyValue, size uint64) {
+	if fmt.Sprint(table.entries) != fmt.Sprint(want) || table.size != size {
+		t.Fatalf("Error %s: want=%v (size %d), ans=%v (size %d)", name, want, size, table.entries, table.size)
+	}
+}
+
+// RFC 9204 Appendix B. Encoding and Decoding Examples
+func TestAppendixB(t *testing.T) {
+	decoderStream := &bytes.Buffer{}
+	d := NewDecoder(decoderStream, 220, 1)
+
+	// B.1 Literal Field Line with Name Reference
+	fields, err := d.Decode(0, wire(t, "0000 510b 2f69 6e64 6578 2e68 746d 6c"))
+	if err != nil || fmt.Sprint(fields) != "[{:path /index.html}]" {
+		t.Fatalf("Error B.1: ans=%v %v", fields, err)
+	}
+	if decoderStream.Len() != 0 {
+		t.Fatalf("Error B.1: no decoder instruction is expected, ans=%x", decoderStream.Bytes())
+	}
+
+	// B.2 Dynamic Table
+	err = d.HandleEncoderStream(wire(t, "3fbd01 c00f 7777 772e 6578 616d 706c 652e 636f 6d c10c 2f73 616d 706c 652f 7061 7468"))
+	if err != nil {
+		t.Fatalf("Error B.2: %v", err)
+	}
+	checkTable(t, "B.2", d.table, []hpack.KeyValue{
+		{Key: ":authority", Value: "www.example.com"},
+		{Key: ":path", Value: "/sample/path"},
+	}, 106)
+	fields, err = d.Decode(4, wire(t, "0381 10 11"))
+	if err != nil || fmt.Sprint(fields) != "[{:authority www.example.com} {:path /sample/path}]" {
+		t.Fatalf("Error B.2: ans=%v %v", fields, err)
+	}
+	if hex.EncodeToString(decoderStream.Bytes()) != "84" {
+		t.Fatalf("Error B.2: want=84, ans=%x", decoderStream.Bytes())
+	}
+	decoderStream.Reset()
+
+	// B.3 Speculative Insert
+	err = d.HandleEncoderStream(wire(t, "4a63 7573 746f 6d2d 6b65 790c 6375 7374 6f6d 2d76 616c 7565"))
+	if err != nil {
+		t.Fatalf("Error B.3: %v", err)
+	}
+	d.AcknowledgeInserts()
+	if hex.EncodeToString(decoderStream.Bytes()) != "01" {
+		t.Fatalf("Error B.3: want=01, ans=%x", decoderStream.Bytes())
+	}
+	checkTable(t, "B.3", d.table, []hpack.KeyValue{
+		{Key: ":authority", Value: "www.example.com"},
+		{Key: ":path", Value: "/sample/path"},
+		{Key: "custom-key", Value: "custom-value"},
+	}, 160)
+	decoderStream.Reset()
+
+	// B.4 Duplicate Instruction, Stream Cancellation
+	//  the section is delivered before the Duplicate instruction, so it is blocked
+	//  and then cancelled.
+	_, err = d.Decode(8, wire(t, "0500 80 c1 81"))
+	if err != ErrBlocked {
+		t.Fatalf("Error B.4: want=ErrBlocked, ans=%v", err)
+	}
+	if err := d.CancelStream(8); err != nil {
+		t.Fatalf("Error B.4: %v", err)
+	}
+	if hex.EncodeToString(decoderStream.Bytes()) != "48" {
+		t.Fatalf("Error B.4: want=48, ans=%x", decoderStream.Bytes())
+	}
+	decoderStream.Reset()
+	if err := d.HandleEncoderStream(wire(t, "02")); err != nil {
+		t.Fatalf("Error B.4: %v", err)
+	}
+	checkTable(t, "B.4", d.table, []hpack.KeyValue{
+		{Key: ":authority", Value: "www.example.com"},
+		{Key: ":path", Value: "/sample/path"},
+		{Key: "custom-key", Value: "custom-value"},
+		{Key: ":authority", Value: "www.example.com"},
+	}, 217)
+	fields, err = d.Decode(8, wire(t, "0500 80 c1 81"))
+	if err != nil || fmt.Sprint(fields) != "[{:authority www.example.com} {:path /} {custom-key custom-value}]" {
+		t.Fatalf("Error B.4: ans=%v %v", fields, err)
+	}
+	decoderStream.Reset()
+
+	// B.5 Dynamic Table Insert, Eviction
+	if err := d.HandleEncoderStream(wire(t, "810d 6375 7374 6f6d 2d76 616c 7565 32")); err != nil {
+		t.Fatalf("Error B.5: %v", err)
+	}
+	checkTable(t, "B.5", d.table, []hpack.KeyValue{
+		{Key: ":path", Value: "/sample/path"},
+		{Key: "custom-key", Value: "custom-value"},
+		{Key: ":authority", Value: "www.example.com"},
+		{Key: "custom-key", Value: "custom-value2"},
+	}, 215)
+	if d.table.dropped != 1 || d.InsertCount() != 5 {
+		t.Fatalf("Error B.5: want dropped=1 insert count=5, ans=%d %d", d.table.dropped, d.InsertCount())
+	}
+}
+
+// the encoder and the decoder talk through in-memory streams
+type pipe struct {
+	encoderStream *bytes.Buffer
+	decoderStream *bytes.Buffer
+	enc           *Encoder
+	dec           *Decoder
+	unblocked     map[uint64][]hpack.KeyValue
+}
+
+func newPipe(capacity uint64, blockedStreams uint64) *pipe {
+	p := &pipe{
+		encoderStream: &bytes.Buffer{},
+		decoderStream: &bytes.Buffer{},
+		unblocked:     map[uint64][]hpack.KeyValue{},
+	}
+	p.enc = NewEncoder(p.encoderStream, capacity, blockedStreams)
+	p.dec = NewDecoder(p.decoderStream, capacity, blockedStreams)
+	p.dec.Unblocked = func(id uint64, fields []hpack.KeyValue, err error) {
+		p.unblocked[id] = fields
+	}
+	return p
+}
+
+// flushEncoderStream delivers the encoder stream byte by byte
+func (p *pipe) flushEncoderStream(t *testing.T) {
+	for _, c := range p.encoderStream.Bytes() {
+		if err := p.dec.HandleEncoderStream([]byte{c}); err != nil {
+			t.Fatalf("Error HandleEncoderStream: %v", err)
+		}
+	}
+	p.encoderStream.Reset()
+}
+
+func (p *pipe) flushDecoderStream(t *testing.T) {
+	p.dec.AcknowledgeInserts()
+	if err := p.enc.HandleDecoderStream(p.decoderStream.Bytes()); err != nil {
+		t.Fatalf("Error HandleDecoderStream: %v", err)
+	}
+	p.decoderStream.Reset()
+}
+
+var requests = [][]hpack.KeyValue{
+	{{Key: ":method", Value: "GET"}, {Key: ":scheme", Value: "https"}, {Key: ":authority", Value: "www.example.com"}, {Key: ":path", Value: "/"}, {Key: "user-agent", Value: "minihpack"}, {Key: "x-trace", Value: "1"}},
+	{{Key: ":method", Value: "GET"}, {Key: ":scheme", Value: "https"}, {Key: ":authority", Value: "www.example.com"}, {Key: ":path", Value: "/style.css"}, {Key: "user-agent", Value: "minihpack"}, {Key: "x-trace", Value: "2"}},
+	{{Key: ":method", Value: "POST"}, {Key: ":scheme", Value: "https"}, {Key: ":authority", Value: "www.example.com"}, {Key: ":path", Value: "/api"}, {Key: "user-agent", Value: "minihpack"}, {Key: "content-type", Value: "application/json"}},
+}
+
+func TestEncodeDecode(t *testing.T) {
+	p := newPipe(4096, 0)
+	if err := p.enc.SetCapacity(4096); err != nil {
+		t.Fatalf("Error SetCapacity: %v", err)
+	}
+	sizes := []int{}
+	for i := 0; i < 3; i++ {
+		for c, fields := range requests {
+			id := uint64(4 * (3*i + c))
+			b, err := p.enc.Encode(id, fields)
+			if err != nil {
+				t.Fatalf("Error Encode: %v", err)
+			}
+			// sections never block when SETTINGS_QPACK_BLOCKED_STREAMS = 0
+			decoded, err := p.dec.Decode(id, b)
+			if err != nil || fmt.Sprint(decoded) != fmt.Sprint(fields) {
+				t.Fatalf("Error Decode: want=%v, ans=%v %v", fields, decoded, err)
+			}
+			if c == 0 {
+				sizes = append(sizes, len(b))
+			}
+			p.flushEncoderStream(t)
+			p.flushDecoderStream(t)
+		}
+	}
+	if sizes[1] >= sizes[0] {
+		t.Fatalf("Error Encode: acknowledged entries are not used, sizes=%v", sizes)
+	}
+	if p.enc.KnownReceivedCount() != p.dec.InsertCount() {
+		t.Fatalf("Error KnownReceivedCount: want=%d, ans=%d", p.dec.InsertCount(), p.enc.KnownReceivedCount())
+	}
+}
+
+func TestBlockedStream(t *testing.T) {
+	p := newPipe(4096, 1)
+	p.enc.SetCapacity(4096)
+
+	// the section arrives before the encoder stream
+	b, _ := p.enc.Encode(0, requests[0])
+	if _, err := p.dec.Decode(0, b); err != ErrBlocked {
+		t.Fatalf("Error Decode: want=ErrBlocked, ans=%v", err)
+	}
+	// only one stream may be blocked: the next stream doesn't refer to new entries
+	b2, _ := p.enc.Encode(4, requests[1])
+	if _, err := p.dec.Decode(4, b2); err == ErrBlocked {
+		t.Fatalf("Error Decode: second stream is blocked")
+	}
+
+	p.flushEncoderStream(t)
+	if fmt.Sprint(p.unblocked[0]) != fmt.Sprint(requests[0]) {
+		t.Fatalf("Error Unblocked: want=%v, ans=%v", requests[0], p.unblocked[0])
+	}
+	// Section Acknowledgment for stream 0 and 4
+	p.flushDecoderStream(t)
+	if len(p.enc.sections) != 0 || p.enc.KnownReceivedCount() != p.enc.InsertCount() {
+		t.Fatalf("Error HandleDecoderStream: sections=%v known=%d", p.enc.sections, p.enc.KnownReceivedCount())
+	}
+
+	// too many blocked streams: the sections refer to an entry which is not inserted yet
+	section := appendInt(nil, 0, 8, encodeInsertCount(p.dec.InsertCount()+1, 4096))
+	section = append(section, 0x00, 0x80)
+	if _, err := p.dec.Decode(8, section); err != ErrBlocked {
+		t.Fatalf("Error Decode: want=ErrBlocked, ans=%v", err)
+	}
+	if _, err := p.dec.Decode(12, section); err == nil || err == ErrBlocked {
+		t.Fatalf("Error Decode: want=QPACK_DECOMPRESSION_FAILED, ans=%v", err)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestUnblock(t *testing.T) {
+	// Required Insert Count = 1: blocked until the first entry is inserted
+	prefix := append(appendInt(nil, 0, 8, encodeInsertCount(1, 4096)), 0x00)
+	valid := append(append([]byte{}, prefix...), 0xd1)        // :method: GET
+	broken := append(append([]byte{}, prefix...), 0xff, 0x7f) // static index 190
+	calls := map[uint64]int{}
+	d := NewDecoder(&bytes.Buffer{}, 4096, 1)
+	d.Unblocked = func(id uint64, fields []hpack.KeyValue, err error) {
+		calls[id]++
+	}
+
+	// the sections of one stream are one blocked stream
+	for _, b := range [][]byte{valid, broken} {
+		if _, err := d.Decode(0, b); err != ErrBlocked {
+			t.Fatalf("Error Decode: want=ErrBlocked, ans=%v", err)
+		}
+	}
+	if _, err := d.Decode(4, valid); err == nil || err == ErrBlocked {
+		t.Fatalf("Error Decode: want=QPACK_DECOMPRESSION_FAILED, ans=%v", err)
+	}
+
+	// the broken section is reported, and the sections are not decoded again
+	if err := d.HandleEncoderStream(wire(t, "3fe11f 4161 0162")); err == nil {
+		t.Fatalf("Error HandleEncoderStream: broken section doesn't send error")
+	}
+	if err := d.HandleEncoderStream(wire(t, "4161 0163")); err != nil {
+		t.Fatalf("Error HandleEncoderStream: %v", err)
+	}
+	if calls[0] != 2 || len(d.blocked) != 0 {
+		t.Fatalf("Error Unblocked: want=2 calls, ans=%d (blocked=%d)", calls[0], len(d.blocked))
+	}
+
+	// the error of the decoder stream is returned too
+	d = NewDecoder(errWriter{}, 4096, 1)
+	d.Decode(0, valid)
+	if err := d.HandleEncoderStream(wire(t, "3fe11f 4161 0162")); err != io.ErrClosedPipe {
+		t.Fatalf("Error HandleEncoderStream: want=%v, ans=%v", io.ErrClosedPipe, err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	// room for about three entries
+	p := newPipe(128, 100)
+	p.enc.SetCapacity(128)
+	for i := 0; i < 50; i++ {
+		fields := []hpack.KeyValue{{Key: "x-count", Value: fmt.Sprint(i)}, {Key: "x-name", Value: strings.Repeat("a", i%7)}}
+		id := uint64(4 * i)
+		b, err := p.enc.Encode(id, fields)
+		if err != nil {
+			t.Fatalf("Error Encode: %v", err)
+		}
+		p.flushEncoderStream(t)
+		decoded, err := p.dec.Decode(id, b)
+		if err != nil || fmt.Sprint(decoded) != fmt.Sprint(fields) {
+			t.Fatalf("Error Decode %d: want=%v, ans=%v %v", i, fields, decoded, err)
+		}
+		if i%3 == 0 {
+			p.flushDecoderStream(t)
+		}
+	}
+	if p.dec.table.dropped == 0 {
+		t.Fatalf("Error Eviction: no entry is evicted")
+	}
+}
+
+func TestEncoderStreamError(t *testing.T) {
+	d := NewDecoder(&bytes.Buffer{}, 100, 0)
+	// capacity exceeds the maximum
+	err := d.HandleEncoderStream(wire(t, "3f e101"))
+	if e, ok := err.(Error); !ok || e.Code != QPACK_ENCODER_STREAM_ERROR {
+		t.Fatalf("Error HandleEncoderStream: want=QPACK_ENCODER_STREAM_ERROR, ans=%v", err)
+	}
+	// duplicate of an empty table
+	d = NewDecoder(&bytes.Buffer{}, 100, 0)
+	err = d.HandleEncoderStream(wire(t, "00"))
+	if e, ok := err.(Error); !ok || e.Code != QPACK_ENCODER_STREAM_ERROR {
+		t.Fatalf("Error HandleEncoderStream: want=QPACK_ENCODER_STREAM_ERROR, ans=%v", err)
+	}
+}
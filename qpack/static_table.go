@@ -0,0 +1,130 @@
+package qpack
+
+import (
+	hpack "github.com/rung/minihpack"
+)
+
+// Appendix A. Static Table
+//  unlike HPACK, the index starts from 0.
+var staticTable = [99]hpack.KeyValue{
+	hpack.KeyValue{Key: ":authority"},
+	hpack.KeyValue{Key: ":path", Value: "/"},
+	hpack.KeyValue{Key: "age", Value: "0"},
+	hpack.KeyValue{Key: "content-disposition"},
+	hpack.KeyValue{Key: "content-length", Value: "0"},
+	hpack.KeyValue{Key: "cookie"},
+	hpack.KeyValue{Key: "date"},
+	hpack.KeyValue{Key: "etag"},
+	hpack.KeyValue{Key: "if-modified-since"},
+	hpack.KeyValue{Key: "if-none-match"},
+	hpack.KeyValue{Key: "last-modified"},
+	hpack.KeyValue{Key: "link"},
+	hpack.KeyValue{Key: "location"},
+	hpack.KeyValue{Key: "referer"},
+	hpack.KeyValue{Key: "set-cookie"},
+	hpack.KeyValue{Key: ":method", Value: "CONNECT"},
+	hpack.KeyValue{Key: ":method", Value: "DELETE"},
+	hpack.KeyValue{Key: ":method", Value: "GET"},
+	hpack.KeyValue{Key: ":method", Value: "HEAD"},
+	hpack.KeyValue{Key: ":method", Value: "OPTIONS"},
+	hpack.KeyValue{Key: ":method", Value: "POST"},
+	hpack.KeyValue{Key: ":method", Value: "PUT"},
+	hpack.KeyValue{Key: ":scheme", Value: "http"},
+	hpack.KeyValue{Key: ":scheme", Value: "https"},
+	hpack.KeyValue{Key: ":status", Value: "103"},
+	hpack.KeyValue{Key: ":status", Value: "200"},
+	hpack.KeyValue{Key: ":status", Value: "304"},
+	hpack.KeyValue{Key: ":status", Value: "404"},
+	hpack.KeyValue{Key: ":status", Value: "503"},
+	hpack.KeyValue{Key: "accept", Value: "*/*"},
+	hpack.KeyValue{Key: "accept", Value: "application/dns-message"},
+	hpack.KeyValue{Key: "accept-encoding", Value: "gzip, deflate, br"},
+	hpack.KeyValue{Key: "accept-ranges", Value: "bytes"},
+	hpack.KeyValue{Key: "access-control-allow-headers", Value: "cache-control"},
+	hpack.KeyValue{Key: "access-control-allow-headers", Value: "content-type"},
+	hpack.KeyValue{Key: "access-control-allow-origin", Value: "*"},
+	hpack.KeyValue{Key: "cache-control", Value: "max-age=0"},
+	hpack.KeyValue{Key: "cache-control", Value: "max-age=2592000"},
+	hpack.KeyValue{Key: "cache-control", Value: "max-age=604800"},
+	hpack.KeyValue{Key: "cache-control", Value: "no-cache"},
+	hpack.KeyValue{Key: "cache-control", Value: "no-store"},
+	hpack.KeyValue{Key: "cache-control", Value: "public, max-age=31536000"},
+	hpack.KeyValue{Key: "content-encoding", Value: "br"},
+	hpack.KeyValue{Key: "content-encoding", Value: "gzip"},
+	hpack.KeyValue{Key: "content-type", Value: "application/dns-message"},
+	hpack.KeyValue{Key: "content-type", Value: "application/javascript"},
+	hpack.KeyValue{Key: "content-type", Value: "application/json"},
+	hpack.KeyValue{Key: "content-type", Value: "application/x-www-form-urlencoded"},
+	hpack.KeyValue{Key: "content-type", Value: "image/gif"},
+	hpack.KeyValue{Key: "content-type", Value: "image/jpeg"},
+	hpack.KeyValue{Key: "content-type", Value: "image/png"},
+	hpack.KeyValue{Key: "content-type", Value: "text/css"},
+	hpack.KeyValue{Key: "content-type", Value: "text/html; charset=utf-8"},
+	hpack.KeyValue{Key: "content-type", Value: "text/plain"},
+	hpack.KeyValue{Key: "content-type", Value: "text/plain;charset=utf-8"},
+	hpack.KeyValue{Key: "range", Value: "bytes=0-"},
+	hpack.KeyValue{Key: "strict-transport-security", Value: "max-age=31536000"},
+	hpack.KeyValue{Key: "strict-transport-security", Value: "max-age=31536000; includesubdomains"},
+	hpack.KeyValue{Key: "strict-transport-security", Value: "max-age=31536000; includesubdomains; preload"},
+	hpack.KeyValue{Key: "vary", Value: "accept-encoding"},
+	hpack.KeyValue{Key: "vary", Value: "origin"},
+	hpack.KeyValue{Key: "x-content-type-options", Value: "nosniff"},
+	hpack.KeyValue{Key: "x-xss-protection", Value: "1; mode=block"},
+	hpack.KeyValue{Key: ":status", Value: "100"},
+	hpack.KeyValue{Key: ":status", Value: "204"},
+	hpack.KeyValue{Key: ":status", Value: "206"},
+	hpack.KeyValue{Key: ":status", Value: "302"},
+	hpack.KeyValue{Key: ":status", Value: "400"},
+	hpack.KeyValue{Key: ":status", Value: "403"},
+	hpack.KeyValue{Key: ":status", Value: "421"},
+	hpack.KeyValue{Key: ":status", Value: "425"},
+	hpack.KeyValue{Key: ":status", Value: "500"},
+	hpack.KeyValue{Key: "accept-language"},
+	hpack.KeyValue{Key: "access-control-allow-credentials", Value: "FALSE"},
+	hpack.KeyValue{Key: "access-control-allow-credentials", Value: "TRUE"},
+	hpack.KeyValue{Key: "access-control-allow-headers", Value: "*"},
+	hpack.KeyValue{Key: "access-control-allow-methods", Value: "get"},
+	hpack.KeyValue{Key: "access-control-allow-methods", Value: "get, post, options"},
+	hpack.KeyValue{Key: "access-control-allow-methods", Value: "options"},
+	hpack.KeyValue{Key: "access-control-expose-headers", Value: "content-length"},
+	hpack.KeyValue{Key: "access-control-request-headers", Value: "content-type"},
+	hpack.KeyValue{Key: "access-control-request-method", Value: "get"},
+	hpack.KeyValue{Key: "access-control-request-method", Value: "post"},
+	hpack.KeyValue{Key: "alt-svc", Value: "clear"},
+	hpack.KeyValue{Key: "authorization"},
+	hpack.KeyValue{Key: "content-security-policy", Value: "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	hpack.KeyValue{Key: "early-data", Value: "1"},
+	hpack.KeyValue{Key: "expect-ct"},
+	hpack.KeyValue{Key: "forwarded"},
+	hpack.KeyValue{Key: "if-range"},
+	hpack.KeyValue{Key: "origin"},
+	hpack.KeyValue{Key: "purpose", Value: "prefetch"},
+	hpack.KeyValue{Key: "server"},
+	hpack.KeyValue{Key: "timing-allow-origin", Value: "*"},
+	hpack.KeyValue{Key: "upgrade-insecure-requests", Value: "1"},
+	hpack.KeyValue{Key: "user-agent"},
+	hpack.KeyValue{Key: "x-forwarded-for"},
+	hpack.KeyValue{Key: "x-frame-options", Value: "deny"},
+	hpack.KeyValue{Key: "x-frame-options", Value: "sameorigin"},
+}
+
+// searchStaticTable returns the index of the exact match (full == true)
+// or the first entry with the same name.
+func searchStaticTable(kv hpack.KeyValue) (index uint64, full bool, ok bool) {
+	nameIndex := -1
+	for c, v := range staticTable {
+		if v.Key != kv.Key {
+			continue
+		}
+		if v.Value == kv.Value {
+			return uint64(c), true, true
+		}
+		if nameIndex < 0 {
+			nameIndex = c
+		}
+	}
+	if nameIndex < 0 {
+		return 0, false, false
+	}
+	return uint64(nameIndex), false, true
+}
@@ -0,0 +1,100 @@
+package qpack
+
+import (
+	"errors"
+
+	hpack "github.com/rung/minihpack"
+)
+
+// 3.2. Dynamic Table
+//  entries are addressed by the absolute index (0 = first inserted entry).
+//
+//         +-----+---------------+-------+
+//         | n-1 |      ...      |   d   |  Absolute Index
+//         + - - +---------------+ - - - +
+//         |  0  |      ...      | n-d-1 |  Relative Index (encoder instructions)
+//         +-----+---------------+-------+
+//         ^                             |
+//         |                             V
+//   Insertion Point               Dropping Point
+type dynamicTable struct {
+	entries  []hpack.KeyValue // oldest first
+	dropped  uint64           // number of evicted entries (absolute index of entries[0])
+	size     uint64
+	capacity uint64
+}
+
+// insertCount returns the total number of inserted entries.
+func (t *dynamicTable) insertCount() uint64 {
+	return t.dropped + uint64(len(t.entries))
+}
+
+// get returns the entry of the absolute index.
+func (t *dynamicTable) get(abs uint64) (hpack.KeyValue, bool) {
+	if abs < t.dropped || abs >= t.insertCount() {
+		return hpack.KeyValue{}, false
+	}
+	return t.entries[abs-t.dropped], true
+}
+
+// 3.2.2. Dynamic Table Capacity and Eviction
+// evictable returns how many entries must be evicted to store size octets.
+func (t *dynamicTable) evictable(size uint64) (int, bool) {
+	if size > t.capacity {
+		return 0, false
+	}
+	n := 0
+	free := t.capacity - t.size
+	for free < size {
+		free += entrySize(t.entries[n])
+		n++
+	}
+	return n, true
+}
+
+func (t *dynamicTable) evict(n int) {
+	for _, kv := range t.entries[:n] {
+		t.size -= entrySize(kv)
+	}
+	t.entries = append([]hpack.KeyValue{}, t.entries[n:]...)
+	t.dropped += uint64(n)
+}
+
+func (t *dynamicTable) insert(kv hpack.KeyValue) error {
+	n, ok := t.evictable(entrySize(kv))
+	if !ok {
+		return errors.New("entry is larger than the capacity")
+	}
+	t.evict(n)
+	t.entries = append(t.entries, kv)
+	t.size += entrySize(kv)
+	return nil
+}
+
+func (t *dynamicTable) setCapacity(capacity uint64) {
+	t.capacity = capacity
+	n := 0
+	size := t.size
+	for size > capacity {
+		size -= entrySize(t.entries[n])
+		n++
+	}
+	t.evict(n)
+}
+
+// search returns the newest absolute index of the exact match (full == true)
+// or of the entry with the same name.
+func (t *dynamicTable) search(kv hpack.KeyValue) (abs uint64, full bool, ok bool) {
+	for c := len(t.entries) - 1; c >= 0; c-- {
+		v := t.entries[c]
+		if v.Key == kv.Key && v.Value == kv.Value {
+			return t.dropped + uint64(c), true, true
+		}
+	}
+	for c := len(t.entries) - 1; c >= 0; c-- {
+		if t.entries[c].Key == kv.Key {
+			return t.dropped + uint64(c), false, true
+		}
+	}
+	return 0, false, false
+}
@@ -0,0 +1,238 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// RFC 7541 Appendix C. Examples
+// every block is checked in both directions.
+// decode: wire -> headers, dynamic table, table size
+// encode: headers -> wire, dynamic table, table size
+type appendixBlock struct {
+	wire    string     // hex dump of the header block
+	headers []KeyValue // header list
+	table   []KeyValue // dynamic table after the block ([1] first)
+	size    int        // table size after the block
+}
+
+type appendixCase struct {
+	name    string
+	limit   uint32
+	huffman bool
+	policy  func(kv KeyValue) Indexing
+	blocks  []appendixBlock
+}
+
+func indexAll(kv KeyValue) Indexing   { return IncrementalIndexing }
+func indexNone(kv KeyValue) Indexing  { return WithoutIndexing }
+func indexNever(kv KeyValue) Indexing { return NeverIndexed }
+
+// C.3 / C.4 Request Examples
+var (
+	appendixReq1 = []KeyValue{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+	}
+	appendixReq2 = []KeyValue{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":path", "/"},
+		{":authority", "www.example.com"},
+		{"cache-control", "no-cache"},
+	}
+	appendixReq3 = []KeyValue{
+		{":method", "GET"},
+		{":scheme", "https"},
+		{":path", "/index.html"},
+		{":authority", "www.example.com"},
+		{"custom-key", "custom-value"},
+	}
+	appendixReqTable1 = []KeyValue{
+		{":authority", "www.example.com"},
+	}
+	appendixReqTable2 = []KeyValue{
+		{"cache-control", "no-cache"},
+		{":authority", "www.example.com"},
+	}
+	appendixReqTable3 = []KeyValue{
+		{"custom-key", "custom-value"},
+		{"cache-control", "no-cache"},
+		{":authority", "www.example.com"},
+	}
+)
+
+// C.5 / C.6 Response Examples (SETTINGS_HEADER_TABLE_SIZE = 256)
+var (
+	appendixRes1 = []KeyValue{
+		{":status", "302"},
+		{"cache-control", "private"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{"location", "https://www.example.com"},
+	}
+	appendixRes2 = []KeyValue{
+		{":status", "307"},
+		{"cache-control", "private"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{"location", "https://www.example.com"},
+	}
+	appendixRes3 = []KeyValue{
+		{":status", "200"},
+		{"cache-control", "private"},
+		{"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{"location", "https://www.example.com"},
+		{"content-encoding", "gzip"},
+		{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	}
+	appendixResTable1 = []KeyValue{
+		{"location", "https://www.example.com"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{"cache-control", "private"},
+		{":status", "302"},
+	}
+	appendixResTable2 = []KeyValue{
+		{":status", "307"},
+		{"location", "https://www.example.com"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{"cache-control", "private"},
+	}
+	appendixResTable3 = []KeyValue{
+		{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		{"content-encoding", "gzip"},
+		{"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+	}
+)
+
+var appendixCases = []appendixCase{
+	// C.2 Header Field Representation Examples
+	{"C.2.1", 4096, false, indexAll, []appendixBlock{
+		{"400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572",
+			[]KeyValue{{"custom-key", "custom-header"}},
+			[]KeyValue{{"custom-key", "custom-header"}}, 55},
+	}},
+	{"C.2.2", 4096, false, indexNone, []appendixBlock{
+		{"040c 2f73 616d 706c 652f 7061 7468",
+			[]KeyValue{{":path", "/sample/path"}},
+			[]KeyValue{}, 0},
+	}},
+	{"C.2.3", 4096, false, indexNever, []appendixBlock{
+		{"1008 7061 7373 776f 7264 0673 6563 7265 74",
+			[]KeyValue{{"password", "secret"}},
+			[]KeyValue{}, 0},
+	}},
+	{"C.2.4", 4096, false, indexAll, []appendixBlock{
+		{"82",
+			[]KeyValue{{":method", "GET"}},
+			[]KeyValue{}, 0},
+	}},
+	// C.3 Request Examples without Huffman Coding
+	{"C.3", 4096, false, indexAll, []appendixBlock{
+		{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			appendixReq1, appendixReqTable1, 57},
+		{"8286 84be 5808 6e6f 2d63 6163 6865",
+			appendixReq2, appendixReqTable2, 110},
+		{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+			appendixReq3, appendixReqTable3, 164},
+	}},
+	// C.4 Request Examples with Huffman Coding
+	{"C.4", 4096, true, indexAll, []appendixBlock{
+		{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			appendixReq1, appendixReqTable1, 57},
+		{"8286 84be 5886 a8eb 1064 9cbf",
+			appendixReq2, appendixReqTable2, 110},
+		{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+			appendixReq3, appendixReqTable3, 164},
+	}},
+	// C.5 Response Examples without Huffman Coding
+	{"C.5", 256, false, indexAll, []appendixBlock{
+		{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			appendixRes1, appendixResTable1, 222},
+		{"4803 3330 37c1 c0bf",
+			appendixRes2, appendixResTable2, 222},
+		{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31",
+			appendixRes3, appendixResTable3, 215},
+	}},
+	// C.6 Response Examples with Huffman Coding
+	{"C.6", 256, true, indexAll, []appendixBlock{
+		{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+			appendixRes1, appendixResTable1, 222},
+		{"4883 640e ffc1 c0bf",
+			appendixRes2, appendixResTable2, 222},
+		{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+			appendixRes3, appendixResTable3, 215},
+	}},
+}
+
+// appendixCaseNamed returns the case of name (e.g. "C.3").
+func appendixCaseNamed(t *testing.T, name string) appendixCase {
+	for _, c := range appendixCases {
+		if c.name == name {
+			return c
+		}
+	}
+	t.Fatalf("Error appendixCaseNamed: %s is not found", name)
+	return appendixCase{}
+}
+
+func appendixWire(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("Error appendixWire: %v", err)
+	}
+	return b
+}
+
+func checkAppendixTable(t *testing.T, name string, con HpackConn, want appendixBlock) {
+	if fmt.Sprint(con.DynamicTable) != fmt.Sprint(want.table) {
+		t.Fatalf("Error %s: dynamic table want=%v, ans=%v", name, want.table, con.DynamicTable)
+	}
+	if size := con.Size(); size != want.size {
+		t.Fatalf("Error %s: table size want=%d, ans=%d", name, want.size, size)
+	}
+}
+
+func TestAppendixCDecode(t *testing.T) {
+	for _, c := range appendixCases {
+		con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: c.limit}
+		for i, block := range c.blocks {
+			name := fmt.Sprintf("%s decode block %d", c.name, i+1)
+			decoded, next, err := DecodeHeader(appendixWire(t, block.wire), con)
+			if err != nil {
+				t.Fatalf("Error %s: %v", name, err)
+			}
+			if fmt.Sprint(decoded) != fmt.Sprint(block.headers) {
+				t.Fatalf("Error %s: want=%v, ans=%v", name, block.headers, decoded)
+			}
+			checkAppendixTable(t, name, next, block)
+			con = next
+		}
+	}
+}
+
+func TestAppendixCEncode(t *testing.T) {
+	for _, c := range appendixCases {
+		con := HpackConn{
+			DynamicTable:   []KeyValue{},
+			TableSizeLimit: c.limit,
+			DisableHuffman: !c.huffman,
+			IndexPolicy:    c.policy,
+		}
+		for i, block := range c.blocks {
+			name := fmt.Sprintf("%s encode block %d", c.name, i+1)
+			encoded, next, err := EncodeHeader(block.headers, con)
+			if err != nil {
+				t.Fatalf("Error %s: %v", name, err)
+			}
+			want := hex.EncodeToString(appendixWire(t, block.wire))
+			if ans := hex.EncodeToString(encoded); ans != want {
+				t.Fatalf("Error %s: want=%s, ans=%s", name, want, ans)
+			}
+			checkAppendixTable(t, name, next, block)
+			con = next
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package hpack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Snapshot / Restore
+//  HpackConn is used as the encoder state and the decoder state,
+//  so both sides can be checkpointed with the same format.
+//  {
+//    "version": 1,
+//    "max_size": 4096,
+//    "size": 110,
+//    "inserted": 2,
+//    "entries": [ {"name": "cache-control", "value": "no-cache"}, ... ], ([1] first)
+//    "size_update": true, "min_size": 0,  (encoder: Dynamic Table Size Update not sent yet)
+//    "protocol_size": 4096                (decoder: limit of Dynamic Table Size Update)
+//  }
+//  encoder options (DisableHuffman, IndexPolicy) are not included.
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version  int             `json:"version"`
+	MaxSize  uint32          `json:"max_size"`
+	Size     int             `json:"size"`
+	Inserted uint64          `json:"inserted,omitempty"` // absolute insertion count of [1]
+	Entries  []snapshotEntry `json:"entries"`
+
+	SizeUpdate   bool   `json:"size_update,omitempty"`
+	MinSize      uint32 `json:"min_size,omitempty"`
+	ProtocolSize uint32 `json:"protocol_size,omitempty"`
+}
+
+type snapshotEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Snapshot returns the dynamic table, its size and the max size,
+// with the pending Dynamic Table Size Update.
+func (con *HpackConn) Snapshot() ([]byte, error) {
+	s := snapshot{
+		Version:      snapshotVersion,
+		MaxSize:      con.TableSizeLimit,
+		Size:         tableSize(con.DynamicTable),
+		Inserted:     con.insertCount(),
+		Entries:      []snapshotEntry{},
+		SizeUpdate:   con.sizeUpdate,
+		MinSize:      con.minSize,
+		ProtocolSize: con.protocolSize,
+	}
+	for _, kv := range con.DynamicTable {
+		s.Entries = append(s.Entries, snapshotEntry{kv.Key, kv.Value})
+	}
+	return json.Marshal(s)
+}
+
+// Restore replaces the dynamic table, the max size and the pending size update with a snapshot.
+// con is not modified when the snapshot is invalid.
+func (con *HpackConn) Restore(b []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Restore: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("Restore: unsupported version %d", s.Version)
+	}
+
+	table := []KeyValue{}
+	for _, e := range s.Entries {
+		table = append(table, KeyValue{e.Name, e.Value})
+	}
+	size := tableSize(table)
+	if size != s.Size {
+		return fmt.Errorf("Restore: size mismatch (size=%d, entries=%d)", s.Size, size)
+	}
+	if size > int(s.MaxSize) {
+		return errors.New("Restore: size exceeds max_size")
+	}
+	if s.Inserted == 0 {
+		s.Inserted = uint64(len(table))
+	}
+	if s.Inserted < uint64(len(table)) {
+		return errors.New("Restore: inserted is less than the number of entries")
+	}
+	if s.SizeUpdate && s.MinSize > s.MaxSize {
+		return errors.New("Restore: min_size exceeds max_size")
+	}
+	if s.ProtocolSize != 0 && s.ProtocolSize < s.MaxSize {
+		return errors.New("Restore: max_size exceeds protocol_size")
+	}
+
+	con.DynamicTable = table
+	con.TableSizeLimit = s.MaxSize
+	con.inserted = s.Inserted
+	con.sizeUpdate = s.SizeUpdate
+	con.minSize = s.MinSize
+	con.protocolSize = s.ProtocolSize
+	return nil
+}
@@ -0,0 +1,95 @@
+package hpack
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	// c.4.3 state
+	plain := []KeyValue{
+		KeyValue{":method", "GET"},
+		KeyValue{":scheme", "https"},
+		KeyValue{":path", "/index.html"},
+		KeyValue{":authority", "www.example.com"},
+		KeyValue{"custom-key", "custom-value"},
+	}
+	_, con, _ := EncodeHeader(plain, HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096})
+	b, err := con.Snapshot()
+	if err != nil {
+		t.Fatalf("Error Snapshot: %v", err)
+	}
+
+	restored := HpackConn{}
+	if err := restored.Restore(b); err != nil {
+		t.Fatalf("Error Restore: %v", err)
+	}
+	if fmt.Sprint(restored.DynamicTable) != fmt.Sprint(con.DynamicTable) || restored.TableSizeLimit != 4096 {
+		t.Fatalf("Error Restore: want=%v, ans=%v", con, restored)
+	}
+
+	// the restored state keeps encoding like the original
+	e1, _, _ := EncodeHeader(plain, con)
+	e2, _, _ := EncodeHeader(plain, restored)
+	if fmt.Sprintf("%#x", e1) != fmt.Sprintf("%#x", e2) {
+		t.Fatalf("Error Restore: want=%#x, ans=%#x", e1, e2)
+	}
+}
+
+func TestRestoreError(t *testing.T) {
+	bad := []string{
+		`{"version": 2, "max_size": 4096, "size": 0, "entries": []}`,
+		`{"version": 1, "max_size": 4096, "size": 10, "entries": [{"name": "a", "value": "b"}]}`,
+		`{"version": 1, "max_size": 10, "size": 34, "entries": [{"name": "a", "value": "b"}]}`,
+		`{"version": 1, "max_size": 100, "size": 0, "entries": [], "size_update": true, "min_size": 200}`,
+		`{"version": 1, "max_size": 4096, "size": 0, "entries": [], "protocol_size": 100}`,
+		`{"version": 1,`,
+	}
+	for _, s := range bad {
+		con := HpackConn{DynamicTable: []KeyValue{{"keep", "me"}}, TableSizeLimit: 4096}
+		if err := con.Restore([]byte(s)); err == nil {
+			t.Fatalf("Error Restore: want error, snapshot=%s", s)
+		}
+		if len(con.DynamicTable) != 1 {
+			t.Fatalf("Error Restore: modified on error, ans=%v", con.DynamicTable)
+		}
+	}
+}
+
+func TestSnapshotInserted(t *testing.T) {
+	// c.5: 8 entries are inserted, 5 of them are evicted
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 256}
+	for _, block := range appendixCaseNamed(t, "C.5").blocks {
+		_, con, _ = DecodeHeader(appendixWire(t, block.wire), con)
+	}
+	b, _ := con.Snapshot()
+	restored := HpackConn{}
+	if err := restored.Restore(b); err != nil {
+		t.Fatalf("Error Restore: %v", err)
+	}
+	if e := restored.Entries(); e[0].Absolute != 8 || e[2].Absolute != 6 {
+		t.Fatalf("Error Restore: want=8..6, ans=%v", e)
+	}
+}
+
+func TestSnapshotSizeUpdate(t *testing.T) {
+	// Dynamic Table Size Update is not sent yet
+	con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+	con.SetTableSizeLimit(100)
+	con.SetTableSizeLimit(2048)
+	b, _ := con.Snapshot()
+	restored := HpackConn{}
+	if err := restored.Restore(b); err != nil {
+		t.Fatalf("Error Restore: %v", err)
+	}
+	e1, _, _ := EncodeHeader([]KeyValue{{":method", "GET"}}, con)
+	e2, _, _ := EncodeHeader([]KeyValue{{":method", "GET"}}, restored)
+	if fmt.Sprintf("%x", e2) != "3f453fe10f82" || fmt.Sprintf("%x", e1) != fmt.Sprintf("%x", e2) {
+		t.Fatalf("Error Restore: size update want=%x, ans=%x", e1, e2)
+	}
+
+	// the limit of the decoder is kept
+	if _, _, err := DecodeHeader([]byte{0x3f, 0xe2, 0x0f}, restored); err == nil {
+		t.Fatalf("Error Restore: size update over 2048 doesn't send error")
+	}
+}
@@ -0,0 +1,79 @@
+package hpack
+
+// Stats is the compression statistics of a HpackConn.
+//  the encoder counts what it sends, the decoder counts what it receives.
+type Stats struct {
+	// header fields by representation
+	Indexed             uint64 // 6.1 Indexed Header Field
+	IncrementalIndexing uint64 // 6.2.1 Literal Header Field with Incremental Indexing
+	WithoutIndexing     uint64 // 6.2.2 Literal Header Field without Indexing
+	NeverIndexed        uint64 // 6.2.3 Literal Header Field Never Indexed
+	SizeUpdates         uint64 // 6.3 Dynamic Table Size Update
+
+	// table references (name or name+value)
+	StaticHits  uint64
+	DynamicHits uint64
+
+	// huffman coded string literals
+	HuffmanStrings uint64
+	HuffmanSaved   int64 // raw length - huffman length (octets)
+
+	HeaderBytes uint64 // name + value (encoder: in, decoder: out)
+	WireBytes   uint64 // header block (encoder: out, decoder: in)
+
+	Evictions uint64
+}
+
+// Fields returns the number of header fields.
+func (s Stats) Fields() uint64 {
+	return s.Indexed + s.IncrementalIndexing + s.WithoutIndexing + s.NeverIndexed
+}
+
+// HitRate returns the ratio of fields that referenced the static or dynamic table.
+func (s Stats) HitRate() float64 {
+	if s.Fields() == 0 {
+		return 0
+	}
+	return float64(s.StaticHits+s.DynamicHits) / float64(s.Fields())
+}
+
+// DynamicHitRate returns the ratio of fields that referenced the dynamic table.
+func (s Stats) DynamicHitRate() float64 {
+	if s.Fields() == 0 {
+		return 0
+	}
+	return float64(s.DynamicHits) / float64(s.Fields())
+}
+
+// Stats returns the statistics counted so far.
+func (con *HpackConn) Stats() Stats {
+	return con.stats
+}
+
+// countField counts one header field.
+//  index: referenced table index (0: the name is a string literal)
+func (con *HpackConn) countField(kv KeyValue, indexed bool, indexing Indexing, index uint64) {
+	switch {
+	case indexed:
+		con.stats.Indexed++
+	case indexing == IncrementalIndexing:
+		con.stats.IncrementalIndexing++
+	case indexing == WithoutIndexing:
+		con.stats.WithoutIndexing++
+	default:
+		con.stats.NeverIndexed++
+	}
+
+	if index > 61 {
+		con.stats.DynamicHits++
+	} else if index > 0 {
+		con.stats.StaticHits++
+	}
+	con.stats.HeaderBytes += uint64(len(kv.Key) + len(kv.Value))
+}
+
+// countHuffman counts one huffman coded string literal.
+func (con *HpackConn) countHuffman(raw int, encoded int) {
+	con.stats.HuffmanStrings++
+	con.stats.HuffmanSaved += int64(raw - encoded)
+}
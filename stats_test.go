@@ -0,0 +1,44 @@
+package hpack
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	// c.6: responses with huffman coding and eviction
+	enc := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 256, IndexPolicy: indexAll}
+	dec := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 256}
+	wire := 0
+	for _, block := range appendixCaseNamed(t, "C.6").blocks {
+		var b []byte
+		b, enc, _ = EncodeHeader(block.headers, enc)
+		_, dec, _ = DecodeHeader(b, dec)
+		wire += len(b)
+	}
+
+	for _, s := range []Stats{enc.Stats(), dec.Stats()} {
+		// c.6.1: 4 literals, c.6.2: 1 literal + 3 indexed, c.6.3: 2 indexed + 4 literals
+		if s.Indexed != 6 || s.IncrementalIndexing != 8 || s.WithoutIndexing != 0 || s.NeverIndexed != 0 || s.Fields() != 14 {
+			t.Fatalf("Error Stats: representation ans=%+v", s)
+		}
+		// every field references a table except none (all names are in the static table)
+		if s.StaticHits != 9 || s.DynamicHits != 5 || s.HitRate() != 1 {
+			t.Fatalf("Error Stats: hits ans=%+v", s)
+		}
+		if s.Evictions != 5 || s.WireBytes != uint64(wire) {
+			t.Fatalf("Error Stats: want evictions=5 wire=%d, ans=%+v", wire, s)
+		}
+		if s.HuffmanStrings != 8 || s.HuffmanSaved <= 0 {
+			t.Fatalf("Error Stats: huffman ans=%+v", s)
+		}
+	}
+	if enc.Stats().HeaderBytes != dec.Stats().HeaderBytes {
+		t.Fatalf("Error Stats: header bytes encoder=%d, decoder=%d", enc.Stats().HeaderBytes, dec.Stats().HeaderBytes)
+	}
+
+	// default policy sends cookies as never indexed literals
+	_, con, _ := EncodeHeader([]KeyValue{{"cookie", "a=b"}}, HpackConn{TableSizeLimit: 4096})
+	if s := con.Stats(); s.NeverIndexed != 1 || s.StaticHits != 1 {
+		t.Fatalf("Error Stats: cookie ans=%+v", s)
+	}
+}
@@ -0,0 +1,135 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// hpack-test-case story format
+//  https://github.com/http2jp/hpack-test-case
+//  {
+//    "description": "...",
+//    "cases": [
+//      {
+//        "seqno": 0,
+//        "header_table_size": 4096, (optional)
+//        "wire": "828684...",
+//        "headers": [ { ":method": "GET" }, ... ]
+//      }, ...
+//    ]
+//  }
+type story struct {
+	Description string      `json:"description"`
+	Cases       []storyCase `json:"cases"`
+}
+
+type storyCase struct {
+	Seqno           int                 `json:"seqno"`
+	HeaderTableSize *uint32             `json:"header_table_size"`
+	Wire            string              `json:"wire"`
+	Headers         []map[string]string `json:"headers"`
+}
+
+// header list in the order of the story (one field per object)
+func (c storyCase) headerList() []KeyValue {
+	kv := []KeyValue{}
+	for _, h := range c.Headers {
+		for k, v := range h {
+			kv = append(kv, KeyValue{k, v})
+		}
+	}
+	return kv
+}
+
+// loadStories reads every story matching pattern (e.g. testdata/*.json)
+func loadStories(t *testing.T, pattern string) map[string]story {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatalf("Error loadStories: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("Error loadStories: no story matches %s", pattern)
+	}
+	sort.Strings(files)
+
+	stories := map[string]story{}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Error loadStories: %v", err)
+		}
+		var s story
+		if err := json.Unmarshal(b, &s); err != nil {
+			t.Fatalf("Error loadStories: %s: %v", f, err)
+		}
+		for i, c := range s.Cases {
+			if c.Seqno != i {
+				t.Fatalf("Error loadStories: %s: want seqno=%d, ans=%d", f, i, c.Seqno)
+			}
+		}
+		stories[filepath.Base(f)] = s
+	}
+	return stories
+}
+
+func TestStoryDecode(t *testing.T) {
+	for name, s := range loadStories(t, "testdata/story_*.json") {
+		con := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+		for _, c := range s.Cases {
+			wire, err := hex.DecodeString(c.Wire)
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			decoded, next, err := DecodeHeader(wire, con)
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			if want := c.headerList(); fmt.Sprint(decoded) != fmt.Sprint(want) {
+				t.Fatalf("Error %s seqno %d: want=%v, ans=%v", name, c.Seqno, want, decoded)
+			}
+			if c.HeaderTableSize != nil && next.TableSizeLimit != *c.HeaderTableSize {
+				t.Fatalf("Error %s seqno %d: table size want=%d, ans=%d", name, c.Seqno, *c.HeaderTableSize, next.TableSizeLimit)
+			}
+			con = next
+		}
+	}
+}
+
+// encode the headers of every story with this package and decode them again
+func TestStoryRoundTrip(t *testing.T) {
+	for name, s := range loadStories(t, "testdata/story_*.json") {
+		enc := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+		dec := HpackConn{DynamicTable: []KeyValue{}, TableSizeLimit: 4096}
+		for _, c := range s.Cases {
+			// the decoder follows Dynamic Table Size Update sent by the encoder
+			if c.HeaderTableSize != nil {
+				enc.SetTableSizeLimit(*c.HeaderTableSize)
+			}
+
+			want := c.headerList()
+			encoded, nextEnc, err := EncodeHeader(want, enc)
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			decoded, nextDec, err := DecodeHeader(encoded, dec)
+			if err != nil {
+				t.Fatalf("Error %s seqno %d: %v", name, c.Seqno, err)
+			}
+			if fmt.Sprint(decoded) != fmt.Sprint(want) {
+				t.Fatalf("Error %s seqno %d: want=%v, ans=%v", name, c.Seqno, want, decoded)
+			}
+			if nextEnc.TableSizeLimit != nextDec.TableSizeLimit {
+				t.Fatalf("Error %s seqno %d: table size encoder=%d, decoder=%d", name, c.Seqno, nextEnc.TableSizeLimit, nextDec.TableSizeLimit)
+			}
+			if fmt.Sprint(nextEnc.DynamicTable) != fmt.Sprint(nextDec.DynamicTable) {
+				t.Fatalf("Error %s seqno %d: dynamic table mismatch encoder=%v, decoder=%v", name, c.Seqno, nextEnc.DynamicTable, nextDec.DynamicTable)
+			}
+			enc, dec = nextEnc, nextDec
+		}
+	}
+}